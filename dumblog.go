@@ -20,15 +20,25 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/lmas/dumblog/example"
 	"github.com/lmas/dumblog/internal"
 )
 
 var (
-	initDir  = "./example" // Default dir for the "init" command
-	confOut  = flag.String("out", "./public", "Output dir for generated site")
-	confAddr = flag.String("addr", "127.0.0.1:8080", "Local IP address for hosting the demo web server")
+	initDir       = "./example" // Default dir for the "init" command
+	confOut       = flag.String("out", "./public", "Output dir for generated site")
+	confAddr      = flag.String("addr", "127.0.0.1:8080", "Local IP address for hosting the demo web server")
+	confForce     = flag.Bool("force", false, "Regenerate all files, even if they haven't changed since the last update")
+	confDrafts    = flag.Bool("drafts", false, "Include draft posts when generating the site")
+	confFuture    = flag.Bool("future", false, "Include posts with a future published date when generating the site")
+	confCache     = flag.String("cache", defaultCacheDir(), "Dir for caching converted posts between updates, disabled if empty")
+	confJobs      = flag.Int("jobs", 0, "Max number of pages generated in parallel (default is the number of CPUs)")
+	confKeepGoing = flag.Bool("keep-going", false, "Write all pages that could be generated, even if others had errors")
+	confMinify    = flag.Bool("minify", false, "Remove unnecessary whitespace and comments from html, xml, css and js files")
+	confClean     = flag.Bool("clean", false, "Remove old files from the output dir, that wasn't generated by this update")
 )
 
 type cmd struct {
@@ -44,8 +54,10 @@ func main() {
 
 	commands = []cmd{
 		{"init", runInit, "Writes an example template (default output dir is `./example`)"},
+		{"new", runNew, "Creates a new post in a dir, for example: new ./example/posts \"My Title\""},
 		{"update", runUpdate, "Regenerate the static site"},
 		{"web", runWeb, "Run a demo web server"},
+		{"serve", runServe, "Run a demo web server that regenerates the site and reloads the browser on any changes"},
 		{"version", printVersion, "Print version and exit"},
 		{"help", printHelp, "Print this help message and exit"},
 	}
@@ -89,6 +101,27 @@ func printHelp() {
 	print("")
 }
 
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, internal.Name)
+}
+
+func options() internal.Options {
+	return internal.Options{
+		Force:     *confForce,
+		Drafts:    *confDrafts,
+		Future:    *confFuture,
+		KeepGoing: *confKeepGoing,
+		Jobs:      *confJobs,
+		CacheDir:  *confCache,
+		Minify:    *confMinify,
+		Clean:     *confClean,
+	}
+}
+
 func runInit() {
 	if err := internal.CreateTemplate(initDir, example.Dir, example.Content); err != nil {
 		printFatal("Error creating template: %s", err)
@@ -96,24 +129,42 @@ func runInit() {
 	print("Wrote %s", initDir)
 }
 
+func runNew() {
+	dir, title := flag.Arg(1), flag.Arg(2)
+	path, err := internal.CreatePost(dir, title, time.Now())
+	if err != nil {
+		printFatal("Error creating post: %s", err)
+	}
+	print("Wrote %s", path)
+}
+
 func runWeb() {
-	handler := http.FileServer(http.Dir(*confOut))
+	handler := internal.StaticHandler(*confOut)
 	print("Running on http://%s", *confAddr)
 	if err := http.ListenAndServe(*confAddr, handler); err != nil {
 		printFatal("Error running web server: %s", err)
 	}
 }
 
+func runServe() {
+	dir := flag.Arg(1)
+	server := internal.NewServer(dir, *confOut, options())
+	print("Running on http://%s", *confAddr)
+	if err := server.Run(*confAddr, print); err != nil {
+		printFatal("Error running web server: %s", err)
+	}
+}
+
 func runUpdate() {
 	dir := flag.Arg(1)
-	gen := internal.New()
+	gen := internal.New(options())
 
 	if err := gen.ReadTemplate(dir); err != nil {
-		printFatal("Error reading %q: %s", dir, err)
+		printFatal("Error reading %q:\n%s", dir, err)
 	}
 
 	if err := gen.ExecuteTemplate(*confOut); err != nil {
-		printFatal("Error writing %q: %s", *confOut, err)
+		printFatal("Error writing %q:\n%s", *confOut, err)
 	}
 	print("Wrote %s", *confOut)
 }
@@ -3,9 +3,14 @@ module github.com/lmas/dumblog
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/alecthomas/chroma v0.9.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/dvyukov/go-fuzz v0.0.0-20210429054444-fca39067bc72 // fuzzer complains without this one
+	github.com/tdewolff/minify/v2 v2.9.22
 	github.com/yuin/goldmark v1.3.5
+	github.com/yuin/goldmark-emoji v1.0.1
 	github.com/yuin/goldmark-highlighting v0.0.0-20210428103930-3a9678dbb86c
+	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,140 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// assetsConfig controls how the static assets, like stylesheets and scripts, are written.
+type assetsConfig struct {
+	// Fingerprint writes the assets with a hash of their contents in the filename, like "style.3f9a1c2b.css"
+	Fingerprint bool `yaml:"fingerprint"`
+	// Extensions is the list of file extensions used by the assets, defaults to .css and .js
+	Extensions []string `yaml:"extensions"`
+}
+
+func defaultAssetsConfig() assetsConfig {
+	return assetsConfig{
+		Extensions: []string{".css", ".js"},
+	}
+}
+
+// assets keeps track of the hashes of the static assets in a site.
+type assets struct {
+	dir      string // the site's template dir
+	conf     assetsConfig
+	minifier *minifier // optional
+
+	mu   sync.Mutex
+	sums map[string][]byte // sha256 of the assets, by their relative paths
+}
+
+func newAssets(dir string, conf assetsConfig, mi *minifier) *assets {
+	return &assets{
+		dir:      dir,
+		conf:     conf,
+		minifier: mi,
+		sums:     make(map[string][]byte),
+	}
+}
+
+func (a *assets) isAsset(rel string) bool {
+	ext := filepath.Ext(rel)
+	for _, e := range a.conf.Extensions {
+		if strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// sum returns the sha256 sum of an asset, as it's written to the output dir. It's only read once per run.
+func (a *assets) sum(rel string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.sums[rel]; ok {
+		return s, nil
+	}
+	b, err := os.ReadFile(filepath.Join(a.dir, rel)) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	b, err = a.minifier.minify(rel, b)
+	if err != nil {
+		return nil, err
+	}
+	s := sha256.Sum256(b)
+	a.sums[rel] = s[:]
+	return s[:], nil
+}
+
+// dest returns the relative destination path for a static file, which includes the hash for fingerprinted assets.
+func (a *assets) dest(rel string) (string, error) {
+	if !a.conf.Fingerprint || !a.isAsset(rel) {
+		return rel, nil
+	}
+	s, err := a.sum(rel)
+	if err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(rel)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(rel, ext), hex.EncodeToString(s)[:8], ext), nil
+}
+
+// rel returns the relative source path for an asset link, like "/style.css".
+func (a *assets) rel(link string) (string, error) {
+	rel := filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+link), "/"))
+	if !a.isAsset(rel) || containsDot(rel) {
+		return "", fmt.Errorf("%q is not an asset", link)
+	}
+	return rel, nil
+}
+
+// link returns the http link to an asset, including the hash if it's fingerprinted.
+func (a *assets) link(link string) (string, error) {
+	rel, err := a.rel(link)
+	if err != nil {
+		return "", err
+	}
+	dest, err := a.dest(rel)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("/", filepath.ToSlash(dest)), nil
+}
+
+// integrity returns the subresource integrity hash for an asset, see:
+// https://developer.mozilla.org/en-US/docs/Web/Security/Subresource_Integrity
+func (a *assets) integrity(link string) (string, error) {
+	rel, err := a.rel(link)
+	if err != nil {
+		return "", err
+	}
+	s, err := a.sum(rel)
+	if err != nil {
+		return "", err
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(s), nil
+}
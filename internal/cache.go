@@ -0,0 +1,138 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheMaxAge is how long unused files are kept in the cache, as it's shared by all sites
+	cacheMaxAge time.Duration = 30 * 24 * time.Hour
+	// cachePruneFile records the last time the cache was pruned, so it's only done once per day
+	cachePruneFile string = ".pruned"
+)
+
+// Kinds of data stored in the cache, each in their own sub dir
+var cacheKinds = []string{"body", "image"}
+
+// cache stores generated data between runs, in files named after a hash of all the inputs used to generate them.
+// A nil *cache is valid and never stores anything.
+type cache struct {
+	dir string
+}
+
+func newCache(dir string) *cache {
+	if dir == "" {
+		return nil
+	}
+	return &cache{dir}
+}
+
+func (c *cache) path(kind, key string) string {
+	return filepath.Join(c.dir, kind, key[:2], key)
+}
+
+func (c *cache) get(kind, key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	path := c.path(kind, key)
+	b, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		return nil, false
+	}
+	// Marks the file as recently used, so it's not pruned
+	now := time.Now()
+	os.Chtimes(path, now, now) // #nosec G104
+	return b, true
+}
+
+func (c *cache) put(kind, key string, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	path := c.path(kind, key)
+	if err := createDir(path); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so other jobs can't read a half written file
+	f, err := os.CreateTemp(filepath.Dir(path), key+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()           // #nosec G104
+		os.Remove(f.Name()) // #nosec G104
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name()) // #nosec G104
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// prune removes any files that hasn't been used for cacheMaxAge. Only files that looks like they were written by
+// the cache are removed, in case it's pointing to some other dir by mistake.
+func (c *cache) prune(now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	marker := filepath.Join(c.dir, cachePruneFile)
+	if fi, err := os.Stat(marker); err == nil && now.Sub(fi.ModTime()) < 24*time.Hour {
+		return nil
+	}
+	for _, kind := range cacheKinds {
+		err := filepath.WalkDir(filepath.Join(c.dir, kind), func(path string, de fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			} else if de.IsDir() || !isCacheFile(de.Name()) {
+				return nil
+			}
+			fi, err := de.Info()
+			if err != nil {
+				return err
+			}
+			if now.Sub(fi.ModTime()) > cacheMaxAge {
+				return os.Remove(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeFile(marker, []byte(now.Format(time.RFC3339)))
+}
+
+// isCacheFile returns true for names starting with a hex encoded sha256 hash, like the files (and any left over
+// temporary files) written by put().
+func isCacheFile(name string) bool {
+	if len(name) < 64 {
+		return false
+	}
+	_, err := hex.DecodeString(strings.ToLower(name[:64]))
+	return err == nil
+}
@@ -0,0 +1,207 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressConfig controls the precompressed copies of the text files, that can be served by the web server instead.
+type compressConfig struct {
+	// Gzip writes a .gz copy of each text file
+	Gzip bool `yaml:"gzip"`
+	// Brotli writes a .br copy of each text file
+	Brotli bool `yaml:"brotli"`
+	// MinSize is the smallest file size (in bytes) that gets compressed, defaults to 1024
+	MinSize int `yaml:"minsize"`
+}
+
+func defaultCompressConfig() compressConfig {
+	return compressConfig{
+		MinSize: 1024,
+	}
+}
+
+// File extensions of the text files that are compressed
+var compressTypes = map[string]bool{
+	".html": true,
+	".xml":  true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".txt":  true,
+	".svg":  true,
+}
+
+// encoding is a content encoding supported by the web server, in the order of preference.
+type encoding struct {
+	name string // as used by the Accept-Encoding and Content-Encoding headers
+	ext  string
+}
+
+var encodings = []encoding{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// compressor adds the compressed copies to the outputs of a job.
+// A nil *compressor is valid and doesn't add anything.
+type compressor struct {
+	conf compressConfig
+	key  string // hash of the config
+}
+
+func newCompressor(conf compressConfig) *compressor {
+	if !conf.Gzip && !conf.Brotli {
+		return nil
+	}
+	key := hashStrings(fmt.Sprint(conf.Gzip), fmt.Sprint(conf.Brotli), fmt.Sprint(conf.MinSize))
+	return &compressor{conf, key}
+}
+
+// outputs returns the list of outputs with the compressed copies of the text files added.
+func (c *compressor) outputs(list []output) ([]output, error) {
+	if c == nil {
+		return list, nil
+	}
+	var all []output
+	for _, o := range list {
+		all = append(all, o)
+		if !compressTypes[strings.ToLower(filepath.Ext(o.rel))] {
+			continue
+		}
+		data := o.data
+		if o.copy != "" {
+			var err error
+			data, err = os.ReadFile(o.copy) // #nosec G304
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(data) < c.conf.MinSize {
+			continue
+		}
+		if c.conf.Gzip {
+			b, err := compress(data, func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriterLevel(w, gzip.BestCompression) // Zero header, so it's deterministic
+			})
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, output{rel: o.rel + ".gz", data: b})
+		}
+		if c.conf.Brotli {
+			b, err := compress(data, func(w io.Writer) (io.WriteCloser, error) {
+				return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, output{rel: o.rel + ".br", data: b})
+		}
+	}
+	return all, nil
+}
+
+func compress(data []byte, newWriter func(io.Writer) (io.WriteCloser, error)) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// acceptsEncoding returns true if the request's Accept-Encoding header allows the encoding.
+func acceptsEncoding(r *http.Request, name string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if strings.TrimSpace(parts[0]) != name {
+			continue
+		}
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if !strings.HasPrefix(p, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q <= 0 {
+				return false // Explicitly not acceptable
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// StaticHandler serves the files from dir, using any precompressed .br or .gz copies the client accepts.
+func StaticHandler(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		p := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			p = path.Join(p, "index.html")
+		}
+		for _, e := range encodings {
+			if acceptsEncoding(r, e.name) && serveEncoded(w, r, filepath.Join(dir, filepath.FromSlash(p)), e) {
+				return
+			}
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// serveEncoded serves the compressed copy of the file at path, returning false if there's none.
+func serveEncoded(w http.ResponseWriter, r *http.Request, path string, e encoding) bool {
+	f, err := os.Open(path + e.ext) // #nosec G304
+	if err != nil {
+		return false
+	}
+	// It's only being read, should be safe to ignore Close() errors
+	defer f.Close() // #nosec G307
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	ctype := mime.TypeByExtension(filepath.Ext(path))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", e.name)
+	http.ServeContent(w, r, filepath.Base(path), fi.ModTime(), f)
+	return true
+}
@@ -0,0 +1,103 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// config holds the settings from meta.yaml that are used by the generator itself. All other keys are left as Meta
+// for the templates.
+type config struct {
+	// Unescaped is a compatibility mode for older sites, that renders all templates using text/template without
+	// escaping anything
+	Unescaped bool `yaml:"unescaped"`
+	// Minify removes unnecessary whitespace and comments from the html, xml, css and js files, same as the -minify
+	// flag
+	Minify bool       `yaml:"minify"`
+	Feed   feedConfig `yaml:"feed"`
+	// Markdown controls the extensions and syntax highlighting used for the post bodies
+	Markdown markdownConfig `yaml:"markdown"`
+	// Images controls the resizing of static images
+	Images imagesConfig `yaml:"images"`
+	// Assets controls the fingerprinting of stylesheets and scripts
+	Assets assetsConfig `yaml:"assets"`
+	// Compress controls the precompressed copies of the text files
+	Compress compressConfig `yaml:"compress"`
+
+	Meta Meta `yaml:",inline"`
+}
+
+// feedConfig controls the feeds generated by the generator itself.
+type feedConfig struct {
+	// Section limits the posts to the ones in this first level dir, defaults to all posts
+	Section string `yaml:"section"`
+	// Limit is the max number of posts in a feed, defaults to all posts
+	Limit int `yaml:"limit"`
+	// Content is "summary" (the default) for using the short description or "full" to include the post bodies
+	Content string `yaml:"content"`
+	// Atom is the output path for an Atom feed, it's not written if empty
+	Atom string `yaml:"atom"`
+	// RSS is the output path for a RSS 2.0 feed, it's not written if empty
+	RSS string `yaml:"rss"`
+	// JSON is the output path for a JSON Feed 1.1, it's not written if empty
+	JSON string `yaml:"json"`
+	// Tags writes the same feeds for each tag too, in the tag's dir
+	Tags bool `yaml:"tags"`
+}
+
+func loadConfig(path string) (config, error) {
+	conf := config{
+		Markdown: defaultMarkdownConfig(),
+		Images:   defaultImagesConfig(),
+		Assets:   defaultAssetsConfig(),
+		Compress: defaultCompressConfig(),
+	}
+	b, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil // Ignore it
+		}
+		return conf, err
+	}
+
+	if err := yaml.UnmarshalStrict(b, &conf); err != nil {
+		return conf, yamlErrors(err, 0)
+	}
+	switch conf.Feed.Content {
+	case "", "summary", "full":
+	default:
+		return conf, fmt.Errorf("feed content must be either summary or full, got %q", conf.Feed.Content)
+	}
+	if err := conf.Images.validate(); err != nil {
+		return conf, err
+	}
+
+	// yaml decodes the keys to lower case, make them upper case instead so it's nicer for the templates.
+	// Nested values keeps their keys as is.
+	meta := make(Meta, len(conf.Meta))
+	for k, v := range conf.Meta {
+		meta[strings.Title(k)] = cleanYAML(v)
+	}
+	conf.Meta = meta
+	return conf, nil
+}
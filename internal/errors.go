@@ -0,0 +1,104 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FileError is an error caused by a source file, optionally with the line number where it happened.
+type FileError struct {
+	Path string
+	Line int // 0 if unknown
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Errors is a list of all errors found while reading or writing a site.
+type Errors []error
+
+func (e Errors) Error() string {
+	var list []string
+	for _, err := range e {
+		list = append(list, err.Error())
+	}
+	return strings.Join(list, "\n")
+}
+
+// err returns nil if the list is empty, as a nil Errors is not a nil error.
+func (e Errors) err() error {
+	if len(e) < 1 {
+		return nil
+	}
+	return e
+}
+
+// withPath sets the path of err, and any errors it might contain, to the source file that caused it.
+func withPath(path string, err error) error {
+	switch e := err.(type) {
+	case Errors:
+		var errs Errors
+		for _, err := range e {
+			errs = append(errs, withPath(path, err))
+		}
+		return errs
+	case *FileError:
+		if e.Path == "" {
+			e.Path = path
+		}
+		return e
+	}
+	return &FileError{Path: path, Err: err}
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors converts the errors from yaml into a list of FileError, with the line numbers moved by offset.
+func yamlErrors(err error, offset int) error {
+	msgs := []string{err.Error()}
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	}
+
+	var errs Errors
+	for _, m := range msgs {
+		fe := &FileError{Err: errors.New(m)}
+		if match := yamlLine.FindStringSubmatch(m); match != nil {
+			n, _ := strconv.Atoi(match[1]) // Always a valid number, thanks to the regexp
+			fe.Line = n + offset
+			fe.Err = errors.New(match[2])
+		}
+		errs = append(errs, fe)
+	}
+	return errs.err()
+}
@@ -0,0 +1,407 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// feed holds the data shared by all feed formats.
+type feed struct {
+	title    string
+	subtitle string
+	site     string // absolute url to the site, without the trailing slash
+	link     string // relative link to the page the feed is for
+	self     string // relative link to the feed itself
+	author   string
+	rights   string
+	updated  time.Time
+	entries  []feedEntry
+}
+
+type feedEntry struct {
+	id        string
+	link      string // absolute url to the post
+	title     string
+	summary   string
+	content   string // the html body, only set when using full content
+	published time.Time
+	updated   time.Time
+	tags      []string
+}
+
+// tagURI returns a stable ID for a post, as long as it doesn't move to another site or dir. See RFC 4151.
+func tagURI(host string, published time.Time, link string) string {
+	return fmt.Sprintf("tag:%s,%s:%s", host, published.UTC().Format("2006-01-02"), link)
+}
+
+// loadFeed returns a feed for the posts, using the site's feed settings and meta data.
+func (g *Generator) loadFeed(title, link, self string, posts []Post) (feed, error) {
+	site := strings.TrimSuffix(g.meta.str("Site"), "/")
+	u, err := url.Parse(site)
+	if err != nil || u.Hostname() == "" {
+		return feed{}, fmt.Errorf("feeds needs a valid site url in the meta data, got %q", site)
+	}
+
+	conf := g.conf.Feed
+	var list []Post
+	for _, p := range posts {
+		if conf.Section == "" || firstDir(p.rel) == conf.Section {
+			list = append(list, p)
+		}
+	}
+	if conf.Limit > 0 && len(list) > conf.Limit {
+		list = list[:conf.Limit]
+	}
+
+	f := feed{
+		title:    title,
+		subtitle: "The latest posts from " + title,
+		site:     site,
+		link:     link,
+		self:     self,
+		author:   g.meta.str("Author"),
+		rights:   g.meta.str("Copyright"),
+	}
+	if f.author == "" {
+		// Atom feeds requires an author
+		f.author = g.meta.str("Title")
+		if f.author == "" {
+			f.author = u.Hostname()
+		}
+	}
+	for _, p := range list {
+		e := feedEntry{
+			id:        tagURI(u.Hostname(), p.Meta.Published, p.Link()),
+			link:      site + p.Link(),
+			title:     p.Meta.Title,
+			published: p.Meta.Published,
+			updated:   p.Meta.Updated,
+			tags:      p.Meta.Tags,
+		}
+		if e.updated.IsZero() {
+			e.updated = e.published
+		}
+		e.summary, err = p.Summary()
+		if err != nil {
+			return feed{}, fmt.Errorf("%s: %s", p.source, err)
+		}
+		if conf.Content == "full" {
+			body, err := p.Body()
+			if err != nil {
+				return feed{}, fmt.Errorf("%s: %s", p.source, err)
+			}
+			e.content = absoluteURLs(body, e.link)
+		}
+		if e.updated.After(f.updated) {
+			f.updated = e.updated
+		}
+		f.entries = append(f.entries, e)
+	}
+	return f, nil
+}
+
+// Matches the link attributes in the html rendered from markdown, which always uses double quotes
+var linkAttr = regexp.MustCompile(`\s(href|src|srcset)="([^"]*)"`)
+
+// absoluteURLs resolves all relative links in a post's html against the post's url, as the content is shown
+// outside the site by the feed readers.
+func absoluteURLs(s, link string) string {
+	base, err := url.Parse(link)
+	if err != nil {
+		return s
+	}
+	resolve := func(ref string) string {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return ref
+		}
+		return base.ResolveReference(u).String()
+	}
+	return linkAttr.ReplaceAllStringFunc(s, func(m string) string {
+		sub := linkAttr.FindStringSubmatch(m)
+		val := html.UnescapeString(sub[2])
+		if sub[1] == "srcset" {
+			list := strings.Split(val, ",")
+			for i, c := range list {
+				f := strings.Fields(c)
+				if len(f) > 0 {
+					f[0] = resolve(f[0])
+				}
+				list[i] = strings.Join(f, " ")
+			}
+			val = strings.Join(list, ", ")
+		} else {
+			val = resolve(val)
+		}
+		return fmt.Sprintf(`%s%s="%s"`, m[:1], sub[1], html.EscapeString(val))
+	})
+}
+
+// feedJobs returns the jobs for writing the site's feeds and optionally the feeds for each tag.
+func (g *Generator) feedJobs(params Params, key string) []job {
+	conf := g.conf.Feed
+	source := filepath.Join(g.dir, metaSource)
+	formats := []struct {
+		path   string
+		render func(feed) ([]byte, error)
+	}{
+		{conf.Atom, renderAtom},
+		{conf.RSS, renderRSS},
+		{conf.JSON, renderJSONFeed},
+	}
+
+	var jobs []job
+	add := func(dir, title, link string, posts []Post) {
+		for _, f := range formats {
+			if f.path == "" {
+				continue
+			}
+			rel := filepath.FromSlash(strings.TrimPrefix(f.path, "/"))
+			if dir != "" {
+				rel = filepath.Join(dir, filepath.Base(rel))
+			}
+			render := f.render
+			jobs = append(jobs, job{rel, key, source, func() ([]output, error) {
+				fd, err := g.loadFeed(title, link, path.Join("/", filepath.ToSlash(rel)), posts)
+				if err != nil {
+					return nil, err
+				} else if len(fd.entries) < 1 {
+					return nil, nil // Empty feeds has no updated time and are pretty useless anyway
+				}
+				b, err := render(fd)
+				return []output{{rel: rel, data: b}}, err
+			}})
+		}
+	}
+
+	add("", g.meta.str("Title"), "/", params.Posts)
+	if conf.Tags {
+		for _, t := range params.Tags {
+			add(t.rel(""), g.meta.str("Title")+": "+t.Title, t.Link(), t.Posts)
+		}
+	}
+	return jobs
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   *atomAuthor `xml:"author,omitempty"`
+	Rights   string      `xml:"rights,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+}
+
+func renderAtom(f feed) ([]byte, error) {
+	a := atomFeed{
+		Title:    f.title,
+		Subtitle: f.subtitle,
+		ID:       f.site + f.self,
+		Updated:  f.updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.site + f.link},
+			{Href: f.site + f.self, Rel: "self"},
+		},
+		Rights: f.rights,
+	}
+	a.Author = &atomAuthor{f.author}
+	for _, e := range f.entries {
+		ae := atomEntry{
+			Title:     e.title,
+			ID:        e.id,
+			Links:     []atomLink{{Href: e.link}},
+			Published: e.published.UTC().Format(time.RFC3339),
+			Updated:   e.updated.UTC().Format(time.RFC3339),
+		}
+		for _, t := range e.tags {
+			ae.Categories = append(ae.Categories, atomCategory{t})
+		}
+		if e.summary != "" {
+			ae.Summary = &atomText{Body: e.summary}
+		}
+		if e.content != "" {
+			ae.Content = &atomText{Type: "html", Body: e.content}
+		}
+		a.Entries = append(a.Entries, ae)
+	}
+	return marshalXML(a)
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Copyright     string    `xml:"copyright,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+func renderRSS(f feed) ([]byte, error) {
+	r := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.title,
+			Link:          f.site + f.link,
+			Description:   f.subtitle,
+			Copyright:     f.rights,
+			LastBuildDate: f.updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, e := range f.entries {
+		desc := e.content
+		if desc == "" {
+			desc = e.summary
+		}
+		r.Channel.Items = append(r.Channel.Items, rssItem{
+			Title:       e.title,
+			Link:        e.link,
+			GUID:        rssGUID{ID: e.id},
+			PubDate:     e.published.UTC().Format(time.RFC1123Z),
+			Description: desc,
+			Categories:  e.tags,
+		})
+	}
+	return marshalXML(r)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+type jsonFeed struct {
+	Version     string       `json:"version"`
+	Title       string       `json:"title"`
+	HomePageURL string       `json:"home_page_url"`
+	FeedURL     string       `json:"feed_url"`
+	Description string       `json:"description,omitempty"`
+	Authors     []jsonAuthor `json:"authors,omitempty"`
+	Items       []jsonItem   `json:"items"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html,omitempty"`
+	ContentText   string   `json:"content_text,omitempty"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func renderJSONFeed(f feed) ([]byte, error) {
+	j := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.title,
+		HomePageURL: f.site + f.link,
+		FeedURL:     f.site + f.self,
+		Description: f.subtitle,
+		Items:       []jsonItem{}, // Must not be null
+	}
+	if f.author != "" {
+		j.Authors = []jsonAuthor{{f.author}}
+	}
+	for _, e := range f.entries {
+		item := jsonItem{
+			ID:            e.id,
+			URL:           e.link,
+			Title:         e.title,
+			ContentHTML:   e.content,
+			Summary:       e.summary,
+			DatePublished: e.published.UTC().Format(time.RFC3339),
+			DateModified:  e.updated.UTC().Format(time.RFC3339),
+			Tags:          e.tags,
+		}
+		if item.ContentHTML == "" {
+			item.ContentText = e.summary // Items requires some kind of content
+		}
+		j.Items = append(j.Items, item)
+	}
+	return json.MarshalIndent(j, "", "\t")
+}
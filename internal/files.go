@@ -29,7 +29,8 @@ const (
 )
 
 func trimDir(path, dir string) string {
-	return strings.TrimPrefix(path, dir)
+	// Also trims the leading separator, so firstDir() works on the path
+	return strings.TrimLeft(strings.TrimPrefix(path, dir), "/"+string(os.PathSeparator))
 }
 
 func containsDot(path string) bool {
@@ -88,3 +89,22 @@ func copyFile(r, w string) error {
 	// https://www.joeshaw.org/dont-defer-close-on-writable-files/
 	return dst.Sync()
 }
+
+// writeOutputs writes the outputs to dir and returns the relative paths of the written files.
+func writeOutputs(dir string, list []output) ([]string, error) {
+	var files []string
+	for _, o := range list {
+		path := filepath.Join(dir, o.rel)
+		var err error
+		if o.copy != "" {
+			err = copyFile(o.copy, path)
+		} else {
+			err = writeFile(path, o.data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, o.rel)
+	}
+	return files, nil
+}
@@ -16,18 +16,18 @@
 package internal
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
-	"strings"
+	"sync"
 	text "text/template"
 	"time"
-
-	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -36,11 +36,18 @@ const (
 	// Version is the current version shown for "dumblog version"
 	Version string = "0.1.7"
 
-	postOrig     string = "post.md"
-	postDest     string = "index.html"
-	metaSource   string = ".dumblog/meta.yaml"
-	layoutSource string = ".dumblog/layout.html"
-	postSource   string = ".dumblog/post.html"
+	postOrig      string = "post.md"
+	postDest      string = "index.html"
+	metaSource    string = ".dumblog/meta.yaml"
+	layoutSource  string = ".dumblog/layout.html"
+	postSource    string = ".dumblog/post.html"
+	tagSource     string = ".dumblog/tag.html"
+	tagFeedSource string = ".dumblog/tag.xml"
+	tagFeedDest   string = "feed.xml"
+	tagsDir       string = "tags"
+	seriesSource  string = ".dumblog/series.html"
+	seriesDir     string = "series"
+	chromaDest    string = "chroma.css"
 )
 
 type filePath struct {
@@ -48,65 +55,112 @@ type filePath struct {
 	rel    string // relative destination path
 }
 
+// Options controls how a Generator reads and writes the site.
+type Options struct {
+	// Force regenerates all files, even if their sources hasn't changed since the last run
+	Force bool
+	// Drafts includes posts marked as drafts
+	Drafts bool
+	// Future includes posts with a published date in the future
+	Future bool
+	// KeepGoing writes all pages that could be generated, even if there were errors with other pages
+	KeepGoing bool
+	// CacheDir is where converted posts are cached between runs, nothing is cached if it's empty
+	CacheDir string
+	// Jobs is the max number of pages rendered in parallel, defaults to the number of CPUs if < 1
+	Jobs int
+	// Minify removes unnecessary whitespace and comments from the html, xml, css and js files
+	Minify bool
+	// Clean removes any files written by the previous run, that wasn't written again by this run
+	Clean bool
+}
+
 // Generator is loads & parses templates and then execs & writes them to a directory.
 type Generator struct {
-	meta       Meta
-	tmplLayout *text.Template
-	tmplPost   *text.Template
-	posts      []Post
-	tmpls      []filePath
-	files      []filePath
+	opts        Options
+	cache       *cache
+	dir         string
+	now         time.Time
+	shared      []string // source paths of files used by all pages
+	conf        config
+	markdown    *markdown
+	images      *images // optional
+	assets      *assets
+	minifier    *minifier   // optional
+	compressor  *compressor // optional
+	meta        Meta
+	tmplLayout  *layout
+	tmplPost    *pageTemplate
+	tmplTag     *pageTemplate // optional
+	tmplTagFeed *pageTemplate // optional
+	tmplSeries  *pageTemplate // optional
+	posts       []Post
+	tmpls       []filePath
+	files       []filePath
+	errs        Errors // kept from ReadTemplate, when running with KeepGoing
 }
 
 // New returns a new *Generator instance.
-func New() *Generator {
-	return &Generator{}
-}
-
-func loadMeta(path string) (Meta, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			err = nil // Ignore it
-		}
-		return nil, err
-	}
-
-	var meta Meta
-	if err := yaml.UnmarshalStrict(b, &meta); err != nil {
-		return nil, err
+func New(opts Options) *Generator {
+	return &Generator{
+		opts:  opts,
+		cache: newCache(opts.CacheDir),
 	}
-
-	// yaml decodes the keys to lower case, make them upper case instead so it's nicer for the templates
-	var keys []string
-	for k := range meta {
-		keys = append(keys, k)
-	}
-	for _, k := range keys {
-		meta[strings.Title(k)] = meta[k]
-		delete(meta, k) // the lower case version
-	}
-	return meta, nil
 }
 
 // ReadTemplate loads and parses the template files from `dir`.
 // Optionally tries to load a `.meta.yaml` file, used for providing global meta data to the templates.
+// All errors found in the posts are returned at once, as Errors. When running with KeepGoing, the errors are instead
+// returned later by ExecuteTemplate.
 func (g *Generator) ReadTemplate(dir string) error {
+	dir = filepath.Clean(dir) // The walked paths are cleaned too, see trimDir()
+	g.dir = dir
+	g.now = time.Now()
 	var err error
-	g.meta, err = loadMeta(filepath.Join(dir, metaSource))
+	g.conf, err = loadConfig(filepath.Join(dir, metaSource))
 	if err != nil {
-		return err
+		return withPath(filepath.Join(dir, metaSource), err)
 	}
-	g.tmplLayout, err = loadTemplate(filepath.Join(dir, layoutSource))
+	g.meta = g.conf.Meta
+	g.images = newImages(dir, g.conf.Images, g.cache)
+	g.minifier = newMinifier(g.opts.Minify || g.conf.Minify)
+	g.assets = newAssets(dir, g.conf.Assets, g.minifier)
+	g.compressor = newCompressor(g.conf.Compress)
+	g.markdown, err = newMarkdown(g.conf.Markdown, g.images)
 	if err != nil {
-		return err
+		return withPath(filepath.Join(dir, metaSource), err)
+	}
+	g.tmplLayout, err = loadTemplate(filepath.Join(dir, layoutSource), !g.conf.Unescaped, g.funcs())
+	if err != nil {
+		return withPath(filepath.Join(dir, layoutSource), err)
 	}
 	g.tmplPost, err = cloneTemplate(g.tmplLayout, filepath.Join(dir, postSource))
 	if err != nil {
-		return err
+		return withPath(filepath.Join(dir, postSource), err)
+	}
+	g.shared = []string{filepath.Join(dir, layoutSource), filepath.Join(dir, postSource)}
+	if _, err := os.Stat(filepath.Join(dir, metaSource)); err == nil {
+		g.shared = append(g.shared, filepath.Join(dir, metaSource))
+	}
+	g.tmplTag, err = g.loadOptional(filepath.Join(dir, tagSource))
+	if err != nil {
+		return withPath(filepath.Join(dir, tagSource), err)
+	}
+	g.tmplTagFeed, err = g.loadOptional(filepath.Join(dir, tagFeedSource))
+	if err != nil {
+		return withPath(filepath.Join(dir, tagFeedSource), err)
+	}
+	if g.tmplTagFeed != nil && g.conf.Feed.Tags {
+		// Both would write the tag feeds
+		return withPath(filepath.Join(dir, metaSource), fmt.Errorf("feed tags can't be used with %s", tagFeedSource))
+	}
+	g.tmplSeries, err = g.loadOptional(filepath.Join(dir, seriesSource))
+	if err != nil {
+		return withPath(filepath.Join(dir, seriesSource), err)
 	}
 
-	return filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+	var errs Errors
+	err = filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		} else if de.IsDir() {
@@ -123,9 +177,13 @@ func (g *Generator) ReadTemplate(dir string) error {
 		case filepath.Base(rel) == postOrig: // Posts
 			post, err := readPost(path, filepath.Join(filepath.Dir(rel), postDest))
 			if err != nil {
-				return fmt.Errorf("read %q: %s", path, err)
+				errs = append(errs, withPath(path, err))
+				return nil // Keep looking for more errors
+			}
+			post.body = &postBody{source: path, cache: g.cache, md: g.markdown}
+			if g.isPublished(post) {
+				g.posts = append(g.posts, post)
 			}
-			g.posts = append(g.posts, post)
 
 		case ext == ".html", ext == ".xml", ext == ".txt": // Text templates
 			g.tmpls = append(g.tmpls, filePath{
@@ -141,64 +199,527 @@ func (g *Generator) ReadTemplate(dir string) error {
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if g.opts.KeepGoing {
+		g.errs = errs
+		return nil
+	}
+	return errs.err()
+}
+
+// funcs returns the template funcs that depends on the generator's settings.
+func (g *Generator) funcs() text.FuncMap {
+	return text.FuncMap{
+		"chromacss": func() string {
+			if !g.conf.Markdown.Highlight.Classes {
+				return ""
+			}
+			return path.Join("/", chromaDest)
+		},
+		"srcset": func(link string) string {
+			if g.images == nil {
+				return ""
+			}
+			src, ok := g.images.source(g.dir, link)
+			if !ok {
+				return ""
+			}
+			w, _, err := imageSize(src)
+			if err != nil {
+				return ""
+			}
+			return g.images.srcset(link, w)
+		},
+		"asset": func(link string) (string, error) {
+			return g.assets.link(link)
+		},
+		"integrity": func(link string) (string, error) {
+			return g.assets.integrity(link)
+		},
+	}
+}
+
+// loadOptional loads a template that the site doesn't have to provide, returning nil if it's missing.
+func (g *Generator) loadOptional(path string) (*pageTemplate, error) {
+	tmpl, err := cloneTemplate(g.tmplLayout, path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil // Ignore it
+		}
+		return nil, err
+	}
+	g.shared = append(g.shared, path)
+	return tmpl, nil
 }
 
-func (g *Generator) loadParams() Params {
+// isPublished returns false for drafts, posts scheduled for the future or expired posts, unless the options says
+// to include them.
+func (g *Generator) isPublished(p Post) bool {
+	switch {
+	case p.Meta.Draft && !g.opts.Drafts:
+		return false
+	case p.Meta.Published.After(g.now) && !g.opts.Future:
+		return false
+	case !p.Meta.Expires.IsZero() && !p.Meta.Expires.After(g.now):
+		return false
+	}
+	return true
+}
+
+// loadParams returns the params shared by all templates. The paginated pages are only known after the templates
+// has been rendered, so Pages uses the pages written by the previous run until then.
+func (g *Generator) loadParams(b *build) Params {
 	params := Params{
-		Time:  time.Now(),
-		Meta:  g.meta,
-		Posts: g.posts,
-		Tags:  readTags(g.posts),
+		Time:   g.now,
+		Meta:   g.meta,
+		Posts:  g.posts,
+		Tags:   readTags(g.posts),
+		Series: readSeries(g.posts),
+	}
+	addPages := func(rel string) {
+		params.Pages = append(params.Pages, path.Join("/", filepath.ToSlash(rel)))
+		for _, f := range b.old.Outputs[rel].Files {
+			if f != rel && filepath.Ext(f) == ".html" {
+				params.Pages = append(params.Pages, path.Join("/", filepath.ToSlash(f)))
+			}
+		}
 	}
 
 	for _, f := range g.tmpls {
 		if filepath.Ext(f.rel) != ".html" {
 			continue
 		}
-		url := path.Join("/", filepath.ToSlash(f.rel))
-		params.Pages = append(params.Pages, url)
+		addPages(f.rel)
 	}
 	for _, p := range g.posts {
 		url := path.Join("/", filepath.ToSlash(p.rel))
 		params.Pages = append(params.Pages, url)
 	}
+	if g.tmplTag != nil {
+		for _, t := range params.Tags {
+			addPages(t.rel(postDest))
+		}
+	}
+	if g.tmplSeries != nil {
+		for _, s := range params.Series {
+			addPages(s.rel(postDest))
+		}
+	}
 
 	sortPosts(params.Posts)
 	sortTags(params.Tags)
+	sortSeries(params.Series)
 	sort.Strings(params.Pages)
 	return params
 }
 
-// ExecuteTemplate executes the templates and write the resulting files to dir. It also copy over any other plain files.
-// ReadTemplate must have been called before.
-func (g *Generator) ExecuteTemplate(dir string) error {
-	params := g.loadParams()
+// siteKey returns a hash of everything shared by all pages: the layout, post template and site meta data,
+// plus the meta data of all the posts, the list of pages and the hashes of the assets (and images, if resized).
+func (g *Generator) siteKey(b *build, params Params) (string, error) {
+	list := []string{Version}
+	for _, s := range g.shared {
+		h, err := b.hash(s)
+		if err != nil {
+			return "", err
+		}
+		list = append(list, h)
+	}
+	for _, p := range g.posts {
+		m, err := json.Marshal([]interface{}{p.Meta, p.Params})
+		if err != nil {
+			return "", err
+		}
+		list = append(list, p.rel, string(m))
+	}
+	for _, f := range g.tmpls {
+		list = append(list, f.rel)
+	}
+	list = append(list, params.Pages...)
+	for _, f := range g.files {
+		if !g.assets.isAsset(f.rel) && (g.images == nil || !isImage(f.rel)) {
+			continue
+		}
+		// Pages links to the assets using their hashes and the images using their sizes
+		h, err := b.hash(f.source)
+		if err != nil {
+			return "", err
+		}
+		list = append(list, f.rel, h)
+	}
+	return hashStrings(list...), nil
+}
 
+// postsKey returns a hash of the full contents of all posts, for templates that might include the post bodies.
+func (g *Generator) postsKey(b *build) (string, error) {
+	var list []string
 	for _, p := range g.posts {
-		pa := PostParams{params, p}
-		path := filepath.Join(dir, p.rel)
-		if err := executeTemplate(path, g.tmplPost, pa); err != nil {
-			return err
+		h, err := b.hash(p.source)
+		if err != nil {
+			return "", err
+		}
+		list = append(list, h)
+	}
+	return hashStrings(list...), nil
+}
+
+// summariesKey returns a hash of the summaries of the posts, which are taken from the bodies for posts without
+// a short description.
+func (g *Generator) summariesKey(posts []Post) (string, error) {
+	var list []string
+	for _, p := range posts {
+		s, err := p.Summary()
+		if err != nil {
+			return "", withPath(p.source, err)
+		}
+		list = append(list, p.rel, s)
+	}
+	return hashStrings(list...), nil
+}
+
+// parallel calls fn(i) for each i in [0, n), using up to jobs goroutines (or the number of CPUs if jobs < 1).
+func parallel(n, jobs int, fn func(i int)) {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// output is a file written by a job, either rendered from a template or copied from a source file.
+type output struct {
+	rel  string
+	data []byte
+	copy string // source path to copy from instead of writing data, if set
+}
+
+// job generates the outputs from a single source.
+type job struct {
+	id     string // relative destination path of the first output
+	key    string // hash of all inputs, see build.unchanged()
+	source string
+	run    func() ([]output, error)
+}
+
+// loadJobs returns the jobs for all files that has to be regenerated.
+func (g *Generator) loadJobs(b *build, params Params) ([]job, Errors) {
+	var errs Errors
+	siteKey, err := g.siteKey(b, params)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	postsKey, err := g.postsKey(b)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+
+	bodiesKey := func(t *pageTemplate) string {
+		if t.usesBodies() {
+			return postsKey
 		}
+		return ""
+	}
 
+	var jobs []job
+	sources := make(map[string]string)
+	add := func(j job) {
+		// The jobs are run in parallel, so they can't be allowed to write the same file
+		if prev, ok := sources[j.id]; ok {
+			errs = append(errs, withPath(j.source, fmt.Errorf("%s is already written by %s", j.id, prev)))
+			return
+		}
+		sources[j.id] = j.source
+		if g.minifier != nil {
+			j.key = hashStrings(j.key, "minify")
+		}
+		if g.compressor != nil {
+			j.key = hashStrings(j.key, g.compressor.key)
+		}
+		if !b.unchanged(j.id, j.key) {
+			jobs = append(jobs, j)
+		}
+	}
+
+	for _, p := range g.posts {
+		p := p
+		h, err := b.hash(p.source)
+		if err != nil {
+			errs = append(errs, withPath(p.source, err))
+			continue
+		}
+		pp := newPostParams(params, p)
+		shown := append([]Post{}, pp.Related...)
+		for _, o := range []*Post{pp.Prev, pp.Next} {
+			if o != nil {
+				shown = append(shown, *o)
+			}
+		}
+		// The prev, next and related posts can show their summaries, which might be taken from their bodies
+		sumKey, err := g.summariesKey(shown)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		add(job{p.rel, hashStrings(siteKey, sumKey, h), p.source, func() ([]output, error) {
+			data, err := renderTemplate(g.tmplPost, pp)
+			return []output{{rel: p.rel, data: data}}, err
+		}})
 	}
 
 	for _, f := range g.tmpls {
+		f := f
+		h, err := b.hash(f.source)
+		if err != nil {
+			errs = append(errs, withPath(f.source, err))
+			continue
+		}
 		tmpl, err := cloneTemplate(g.tmplLayout, f.source)
 		if err != nil {
-			return err
+			errs = append(errs, withPath(f.source, err))
+			continue
 		}
-		path := filepath.Join(dir, f.rel)
-		if err := executeTemplate(path, tmpl, params); err != nil {
-			return err
+		add(job{f.rel, hashStrings(siteKey, bodiesKey(tmpl), h), f.source, func() ([]output, error) {
+			return renderPages(f.rel, tmpl, func(pager *Paginator) interface{} {
+				pa := params
+				pa.Paginator = pager
+				return pa
+			})
+		}})
+	}
+
+	for _, t := range params.Tags {
+		for _, f := range []struct {
+			name   string
+			source string
+			tmpl   *pageTemplate
+		}{
+			{postDest, tagSource, g.tmplTag},
+			{tagFeedDest, tagFeedSource, g.tmplTagFeed},
+		} {
+			t, f := t, f
+			if f.tmpl == nil {
+				continue
+			}
+			source := filepath.Join(g.dir, f.source)
+			add(job{t.rel(f.name), hashStrings(siteKey, bodiesKey(f.tmpl)), source, func() ([]output, error) {
+				tmpl, err := cloneTemplate(g.tmplLayout, source) // Each job has to set it's own paginate func
+				if err != nil {
+					return nil, err
+				}
+				return renderPages(t.rel(f.name), tmpl, func(pager *Paginator) interface{} {
+					pa := params
+					pa.Paginator = pager
+					return TagParams{pa, t}
+				})
+			}})
+		}
+	}
+
+	for _, s := range params.Series {
+		s := s
+		if g.tmplSeries == nil {
+			break
+		}
+		source := filepath.Join(g.dir, seriesSource)
+		add(job{s.rel(postDest), hashStrings(siteKey, bodiesKey(g.tmplSeries)), source, func() ([]output, error) {
+			tmpl, err := cloneTemplate(g.tmplLayout, source)
+			if err != nil {
+				return nil, err
+			}
+			return renderPages(s.rel(postDest), tmpl, func(pager *Paginator) interface{} {
+				pa := params
+				pa.Paginator = pager
+				return SeriesParams{pa, s}
+			})
+		}})
+	}
+
+	// The feeds always shows the summaries, which might be excerpts from the bodies
+	feedKey, err := g.summariesKey(params.Posts)
+	if g.conf.Feed.Content == "full" {
+		feedKey, err = postsKey, nil
+	}
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, j := range g.feedJobs(params, hashStrings(siteKey, feedKey)) {
+			add(j)
 		}
 	}
 
+	if conf := g.conf.Markdown.Highlight; conf.Classes {
+		add(job{chromaDest, hashStrings(Version, g.markdown.key), filepath.Join(g.dir, metaSource), func() ([]output, error) {
+			data, err := renderChromaCSS(conf)
+			return []output{{rel: chromaDest, data: data}}, err
+		}})
+	}
+
 	for _, f := range g.files {
-		path := filepath.Join(dir, f.rel)
-		if err := copyFile(f.source, path); err != nil {
+		f := f
+		h, err := b.hash(f.source)
+		if err != nil {
+			errs = append(errs, withPath(f.source, err))
+			continue
+		}
+		if g.images != nil && isImage(f.rel) {
+			add(job{f.rel, hashStrings(h, g.images.key), f.source, func() ([]output, error) {
+				list, err := g.images.resize(f.source, f.rel, h)
+				return append([]output{{rel: f.rel, copy: f.source}}, list...), err
+			}})
+			continue
+		}
+		fingerprint := g.conf.Assets.Fingerprint && g.assets.isAsset(f.rel)
+		add(job{f.rel, hashStrings(h, fmt.Sprint(fingerprint)), f.source, func() ([]output, error) {
+			rel, err := g.assets.dest(f.rel)
+			return []output{{rel: rel, copy: f.source}}, err
+		}})
+	}
+	return jobs, errs
+}
+
+// renderJobs runs all jobs in parallel and returns their outputs, or the errors for the failed jobs.
+func (g *Generator) renderJobs(jobs []job) ([][]output, []error, Errors) {
+	var errs Errors
+	results := make([][]output, len(jobs))
+	failed := make([]error, len(jobs))
+	parallel(len(jobs), g.opts.Jobs, func(i int) {
+		results[i], failed[i] = jobs[i].run()
+		if failed[i] == nil {
+			results[i], failed[i] = g.minifier.outputs(results[i])
+		}
+		if failed[i] == nil {
+			results[i], failed[i] = g.compressor.outputs(results[i])
+		}
+	})
+	for i, err := range failed {
+		if err != nil {
+			errs = append(errs, withPath(jobs[i].source, err))
+		}
+	}
+	owners := make(map[string]int)
+	for i, list := range results {
+		if failed[i] != nil {
+			continue // Might not even have a valid path
+		}
+		for _, o := range list {
+			if k, ok := owners[o.rel]; ok && k != i {
+				errs = append(errs, withPath(jobs[i].source, fmt.Errorf("%s is already written by %s", o.rel, jobs[k].source)))
+				failed[i] = errs[len(errs)-1]
+			}
+			owners[o.rel] = i
+		}
+	}
+	return results, failed, errs
+}
+
+// renderedPages returns the sorted links to all html pages, both rendered and carried over from the previous run.
+func renderedPages(b *build, results [][]output) []string {
+	var list []string
+	for _, o := range b.new.Outputs {
+		for _, f := range o.Files {
+			if filepath.Ext(f) == ".html" {
+				list = append(list, path.Join("/", filepath.ToSlash(f)))
+			}
+		}
+	}
+	for _, outputs := range results {
+		for _, o := range outputs {
+			if filepath.Ext(o.rel) == ".html" {
+				list = append(list, path.Join("/", filepath.ToSlash(o.rel)))
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ExecuteTemplate executes the templates and write the resulting files to dir. It also copy over any other plain files.
+// Files are skipped if none of their sources has changed since the last run, as recorded in the build manifest.
+// All errors are returned at once, as Errors, and nothing is written unless running with KeepGoing.
+// When running with Clean, any old files from the previous run that wasn't written again are removed afterwards.
+// ReadTemplate must have been called before.
+func (g *Generator) ExecuteTemplate(dir string) error {
+	b, err := newBuild(dir, g.opts.Force)
+	if err != nil {
+		return err
+	}
+	if g.opts.Clean {
+		if err := b.canClean(); err != nil {
 			return err
 		}
 	}
-	return nil
+	params := g.loadParams(b)
+	jobs, errs := g.loadJobs(b, params)
+	results, failed, rerrs := g.renderJobs(jobs)
+	errs = append(errs, rerrs...)
+	if pages := renderedPages(b, results); len(errs) == 0 && !equalStrings(pages, params.Pages) {
+		// Some pages were added or removed by the pagination since the previous run, render it all again with
+		// the new list
+		params.Pages = pages
+		jobs, errs = g.loadJobs(b, params)
+		results, failed, rerrs = g.renderJobs(jobs)
+		errs = append(errs, rerrs...)
+	}
+	errs = append(g.errs, errs...)
+	if len(errs) > 0 && !g.opts.KeepGoing {
+		return errs
+	}
+
+	written := make([][]string, len(jobs))
+	werrs := make([]error, len(jobs))
+	parallel(len(jobs), g.opts.Jobs, func(i int) {
+		if failed[i] == nil {
+			written[i], werrs[i] = writeOutputs(dir, results[i])
+		}
+	})
+	for i, j := range jobs {
+		switch {
+		case failed[i] != nil:
+			b.keep(j.id)
+		case werrs[i] != nil:
+			errs = append(errs, werrs[i])
+			b.keep(j.id)
+		default:
+			b.add(j.id, j.key, written[i]...)
+		}
+	}
+	if g.opts.Clean && len(errs) == 0 {
+		// Old files are left alone when there's errors, as they might still be needed
+		if err := b.clean(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := b.save(); err != nil {
+		errs = append(errs, err)
+	}
+	// Pruning the cache is only best-effort too
+	g.cache.prune(g.now) // #nosec G104
+	return errs.err()
 }
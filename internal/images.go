@@ -0,0 +1,260 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"golang.org/x/image/draw"
+)
+
+// imagesConfig controls the resizing of static images.
+type imagesConfig struct {
+	// Widths is the list of widths (in pixels) that images are resized to, nothing is resized if it's empty
+	Widths []int `yaml:"widths"`
+	// Sizes is the sizes attribute added to the images in posts, defaults to "100vw"
+	Sizes string `yaml:"sizes"`
+	// Quality is the quality of resized jpeg images, from 1 to 100 and defaults to 85
+	Quality int `yaml:"quality"`
+}
+
+func defaultImagesConfig() imagesConfig {
+	return imagesConfig{
+		Sizes:   "100vw",
+		Quality: 85,
+	}
+}
+
+func (c imagesConfig) validate() error {
+	for _, w := range c.Widths {
+		if w < 1 {
+			return fmt.Errorf("image widths must be at least 1, got %d", w)
+		}
+	}
+	if c.Quality < 1 || c.Quality > 100 {
+		return fmt.Errorf("image quality must be between 1 and 100, got %d", c.Quality)
+	}
+	return nil
+}
+
+func isImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// variantPath returns the path of an image resized to width, like "photo-480w.jpg" for "photo.jpg".
+func variantPath(p string, width int) string {
+	ext := path.Ext(p)
+	return fmt.Sprintf("%s-%dw%s", strings.TrimSuffix(p, ext), width, ext)
+}
+
+func imageSize(path string) (int, int, error) {
+	f, err := os.Open(path) // #nosec G304
+	if err != nil {
+		return 0, 0, err
+	}
+	// It's only being read, should be safe to ignore Close() errors
+	defer f.Close() // #nosec G307
+	c, _, err := image.DecodeConfig(f)
+	return c.Width, c.Height, err
+}
+
+// resizeImage returns the image scaled down to width, encoded in the same format as the original.
+func resizeImage(path string, width, quality int) ([]byte, error) {
+	f, err := os.Open(path) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	// It's only being read, should be safe to ignore Close() errors
+	defer f.Close() // #nosec G307
+
+	// Only the first frame of animated gifs are used
+	src, format, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(&buf, dst)
+	case "gif":
+		err = gif.Encode(&buf, dst, nil)
+	default:
+		err = fmt.Errorf("unsupported image format %q", format)
+	}
+	return buf.Bytes(), err
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// images resizes the static images in a site and adds the resized variants to the images in the posts.
+// A nil *images is valid and doesn't resize anything.
+type images struct {
+	dir   string // the site's template dir
+	conf  imagesConfig
+	key   string // hash of the config
+	cache *cache
+}
+
+func newImages(dir string, conf imagesConfig, c *cache) *images {
+	if len(conf.Widths) < 1 {
+		return nil
+	}
+	key := hashStrings(fmt.Sprint(conf.Widths), conf.Sizes, fmt.Sprint(conf.Quality))
+	return &images{dir, conf, key, c}
+}
+
+// widths returns the configured widths that are smaller than the original width, in increasing order.
+func (im *images) widths(original int) []int {
+	var list []int
+	seen := make(map[int]bool)
+	for _, w := range im.conf.Widths {
+		if w < original && !seen[w] {
+			list = append(list, w)
+			seen[w] = true
+		}
+	}
+	sort.Ints(list)
+	return list
+}
+
+// source returns the path to the source file of an image link, where dir is the source dir of the page linking
+// to it. Returns false for external links, links to files outside the site or to other kinds of files.
+func (im *images) source(dir, link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || !isImage(u.Path) {
+		return "", false
+	}
+	p := filepath.Join(dir, filepath.FromSlash(u.Path))
+	if path.IsAbs(u.Path) {
+		p = filepath.Join(im.dir, filepath.FromSlash(u.Path))
+	}
+	rel, err := filepath.Rel(im.dir, p)
+	if err != nil || strings.HasPrefix(rel, "..") || containsDot(rel) {
+		return "", false
+	}
+	return p, true
+}
+
+// srcset returns the srcset attribute for an image link and it's resized variants, or an empty string if it
+// doesn't have any.
+func (im *images) srcset(link string, width int) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	var list []string
+	for _, w := range im.widths(width) {
+		v := *u
+		v.Path = variantPath(u.Path, w)
+		list = append(list, fmt.Sprintf("%s %dw", v.String(), w))
+	}
+	if len(list) < 1 {
+		return ""
+	}
+	return strings.Join(append(list, fmt.Sprintf("%s %dw", link, width)), ", ")
+}
+
+// linkedImage is an image linked from a post, with the size it had when the post was converted.
+type linkedImage struct {
+	Path   string
+	Width  int
+	Height int
+}
+
+// imagesChanged returns true if the size of any of the images has changed since they were linked, which would
+// change their attributes.
+func imagesChanged(list []linkedImage) bool {
+	for _, l := range list {
+		w, h, _ := imageSize(l.Path) // Missing images has zero sizes
+		if w != l.Width || h != l.Height {
+			return true
+		}
+	}
+	return false
+}
+
+// setAttributes adds the size, srcset and lazy loading attributes to an image in a post, found in dir.
+// Returns false for images that aren't static files in the site.
+func (im *images) setAttributes(n *ast.Image, dir string) (linkedImage, bool) {
+	link := string(n.Destination)
+	src, ok := im.source(dir, link)
+	if !ok {
+		return linkedImage{}, false
+	}
+	w, h, err := imageSize(src)
+	if err != nil {
+		return linkedImage{Path: src}, true // Leave broken or missing images as they are
+	}
+	n.SetAttributeString("width", []byte(strconv.Itoa(w)))
+	n.SetAttributeString("height", []byte(strconv.Itoa(h)))
+	n.SetAttributeString("loading", []byte("lazy"))
+	if set := im.srcset(link, w); set != "" {
+		n.SetAttributeString("srcset", []byte(set))
+		n.SetAttributeString("sizes", []byte(im.conf.Sizes))
+	}
+	return linkedImage{src, w, h}, true
+}
+
+// resize returns the resized variants of the image at path, with rel being it's relative destination path.
+// The variants are cached between runs. Images that can't be decoded doesn't get any variants.
+func (im *images) resize(path, rel, hash string) ([]output, error) {
+	w, _, err := imageSize(path)
+	if err != nil {
+		return nil, nil // Same as setAttributes(), broken or unknown images are only copied as they are
+	}
+	var list []output
+	for _, width := range im.widths(w) {
+		key := hashStrings(Version, hash, fmt.Sprint(width), fmt.Sprint(im.conf.Quality))
+		data, ok := im.cache.get("image", key)
+		if !ok {
+			data, err = resizeImage(path, width, im.conf.Quality)
+			if err != nil {
+				return nil, err
+			}
+			im.cache.put("image", key, data) // #nosec G104
+		}
+		list = append(list, output{rel: variantPath(rel, width), data: data})
+	}
+	return list, nil
+}
@@ -0,0 +1,261 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestFile is written to the root of the output dir and keeps track of what was generated by the last run.
+const manifestFile string = ".dumblog.json"
+
+type sourceInfo struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+}
+
+type outputInfo struct {
+	Key   string   // hash of all the inputs used to generate the files
+	Files []string // relative paths of the written files
+}
+
+type manifest struct {
+	Version string
+	Sources map[string]sourceInfo
+	Outputs map[string]outputInfo
+}
+
+func newManifest() *manifest {
+	return &manifest{
+		Version: Version,
+		Sources: make(map[string]sourceInfo),
+		Outputs: make(map[string]outputInfo),
+	}
+}
+
+func loadManifest(path string) (*manifest, error) {
+	b, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil // Nothing has been generated yet
+		}
+		return newManifest(), err
+	}
+
+	m := newManifest()
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		// Rebuild everything when a different version generated the files, but remember what was written so the
+		// stale files can still be cleaned up
+		old := newManifest()
+		for id, o := range m.Outputs {
+			old.Outputs[id] = outputInfo{Files: o.Files}
+		}
+		return old, nil
+	}
+	return m, nil
+}
+
+func (m *manifest) save(path string) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// build keeps track of the previous manifest while filling in a new one for the current run.
+type build struct {
+	dir   string
+	force bool
+	old   *manifest
+	new   *manifest
+}
+
+func newBuild(dir string, force bool) (*build, error) {
+	old, err := loadManifest(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	return &build{
+		dir:   dir,
+		force: force,
+		old:   old,
+		new:   newManifest(),
+	}, nil
+}
+
+// hash returns the content hash of a source file. The hash from the previous run is reused if the file's modtime
+// and size hasn't changed since then.
+func (b *build) hash(path string) (string, error) {
+	if s, ok := b.new.Sources[path]; ok {
+		return s.Hash, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := b.old.Sources[path]
+	if !ok || !s.ModTime.Equal(fi.ModTime()) || s.Size != fi.Size() {
+		h, err := hashFile(path)
+		if err != nil {
+			return "", err
+		}
+		s = sourceInfo{
+			ModTime: fi.ModTime(),
+			Size:    fi.Size(),
+			Hash:    h,
+		}
+	}
+	b.new.Sources[path] = s
+	return s.Hash, nil
+}
+
+// unchanged returns true if the output was generated with the same key by the previous run and all of it's files
+// still exists. The old output is then carried over to the new manifest.
+func (b *build) unchanged(id, key string) bool {
+	o, ok := b.old.Outputs[id]
+	if b.force || !ok || o.Key != key {
+		return false
+	}
+	for _, f := range o.Files {
+		if _, err := os.Stat(filepath.Join(b.dir, f)); err != nil {
+			return false
+		}
+	}
+	b.new.Outputs[id] = o
+	return true
+}
+
+func (b *build) add(id, key string, files ...string) {
+	b.new.Outputs[id] = outputInfo{
+		Key:   key,
+		Files: files,
+	}
+}
+
+// keep carries over the old output to the new manifest, without it's key so it's regenerated by the next run.
+// Used for outputs that failed, so their old files aren't cleaned.
+func (b *build) keep(id string) {
+	if o, ok := b.old.Outputs[id]; ok {
+		b.new.Outputs[id] = outputInfo{Files: o.Files}
+	}
+}
+
+// canClean returns an error if the output dir isn't empty and wasn't written by a previous run, as it might
+// contain other files that shouldn't be removed.
+func (b *build) canClean() error {
+	_, err := os.Stat(filepath.Join(b.dir, manifestFile))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("refusing to clean %q, it's missing %s and doesn't look like a previous output dir",
+			b.dir, manifestFile)
+	}
+	return nil
+}
+
+// clean removes the files written by the previous run that wasn't written by this run, along with any dirs that
+// were left empty.
+func (b *build) clean() error {
+	written := make(map[string]bool)
+	for _, o := range b.new.Outputs {
+		for _, f := range o.Files {
+			written[f] = true
+		}
+	}
+	var errs Errors
+	for _, o := range b.old.Outputs {
+		for _, f := range o.Files {
+			f = filepath.Clean(f)
+			if written[f] || filepath.IsAbs(f) || strings.HasPrefix(f, "..") || f == manifestFile {
+				continue
+			}
+			path := filepath.Join(b.dir, f)
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+				continue
+			}
+			removeEmptyDirs(b.dir, filepath.Dir(path))
+		}
+	}
+	return errs.err()
+}
+
+// removeEmptyDirs removes dir and it's parents, up to root, for as long as they're empty.
+func removeEmptyDirs(root, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return // Outside of root
+		}
+		if err := os.Remove(dir); err != nil {
+			return // Not empty
+		}
+	}
+}
+
+func (b *build) save() error {
+	return b.new.save(filepath.Join(b.dir, manifestFile))
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+	// It's only being read, should be safe to ignore Close() errors
+	defer f.Close() // #nosec G307
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashStrings(list ...string) string {
+	h := sha256.New()
+	for _, s := range list {
+		h.Write([]byte(s))
+		h.Write([]byte{0}) // Avoids collisions between "ab", "c" and "a", "bc"
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,85 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildClean(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd) // #nosec G104
+
+	dir := "./public" // Same as the default -out flag, without being cleaned
+	stale := filepath.Join("posts", "old", postDest)
+	b, err := newBuild(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{postDest, stale} {
+		if err := writeFile(filepath.Join(dir, f), []byte("test")); err != nil {
+			t.Fatal(err)
+		}
+		b.add(f, "key", f)
+	}
+	if err := b.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = newBuild(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.canClean(); err != nil {
+		t.Fatalf("canClean() = %q, want nil for a previous output dir", err)
+	}
+	b.add(postDest, "key", postDest)
+	if err := b.clean(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{stale, filepath.Join("posts", "old"), "posts"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s wasn't removed, got error: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, postDest)); err != nil {
+		t.Errorf("%s was removed: %s", postDest, err)
+	}
+}
+
+func TestBuildCleanWithoutManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeFile(filepath.Join(dir, "notes.txt"), []byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := newBuild(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.canClean(); err == nil {
+		t.Fatal("canClean() = nil, want an error for a dir without a manifest")
+	}
+}
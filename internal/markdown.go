@@ -0,0 +1,354 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/yuin/goldmark"
+	emoji "github.com/yuin/goldmark-emoji"
+	highlighting "github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	gtext "github.com/yuin/goldmark/text"
+)
+
+// markdownConfig controls how the post bodies are converted from markdown.
+type markdownConfig struct {
+	// Extensions is the list of enabled goldmark extensions, defaults to gfm and definitionlist
+	Extensions []string        `yaml:"extensions"`
+	Highlight  highlightConfig `yaml:"highlight"`
+	TOC        tocConfig       `yaml:"toc"`
+	// WPM is the reading speed in words per minute, used for estimating the reading time of a post
+	WPM int `yaml:"wpm"`
+}
+
+// highlightConfig controls the syntax highlighting of code blocks.
+type highlightConfig struct {
+	// Style is the name of the chroma style, all available styles can be found at:
+	// https://github.com/alecthomas/chroma/tree/master/styles
+	// (and an outdated gallery at: https://xyproto.github.io/splash/docs/all.html)
+	Style string `yaml:"style"`
+	// LineNumbers adds copy-friendly line numbers to the code blocks
+	LineNumbers bool `yaml:"linenumbers"`
+	// Classes gets rid of the inline css styles and adds classes instead, styled by a generated chroma.css
+	Classes bool `yaml:"classes"`
+	// DarkStyle is an optional chroma style added to chroma.css, used when the browser prefers a dark color scheme
+	DarkStyle string `yaml:"darkstyle"`
+	// TabWidth is the number of spaces used for each tab
+	TabWidth int `yaml:"tabwidth"`
+}
+
+// tocConfig controls which headings are included in the table of contents of a post.
+type tocConfig struct {
+	// MinLevel is the smallest heading level included, defaults to 1
+	MinLevel int `yaml:"minlevel"`
+	// MaxLevel is the largest heading level included, defaults to 6
+	MaxLevel int `yaml:"maxlevel"`
+}
+
+// markdownExtensions maps the extension names that can be used in meta.yaml to goldmark extensions.
+var markdownExtensions = map[string]goldmark.Extender{
+	"gfm":            extension.GFM,
+	"footnotes":      extension.Footnote,
+	"typographer":    extension.Typographer,
+	"definitionlist": extension.DefinitionList,
+	"emoji":          emoji.New(emoji.WithRenderingMethod(emoji.Entity)),
+}
+
+func defaultMarkdownConfig() markdownConfig {
+	return markdownConfig{
+		Extensions: []string{"gfm", "definitionlist"},
+		Highlight: highlightConfig{
+			Style:       "monokai",
+			LineNumbers: true,
+			TabWidth:    8,
+		},
+		TOC: tocConfig{
+			MinLevel: 1,
+			MaxLevel: 6,
+		},
+		WPM: 200,
+	}
+}
+
+func (c markdownConfig) validate() error {
+	for _, e := range c.Extensions {
+		if _, ok := markdownExtensions[e]; !ok {
+			return fmt.Errorf("unknown markdown extension %q", e)
+		}
+	}
+	if _, ok := styles.Registry[c.Highlight.Style]; !ok {
+		return fmt.Errorf("unknown highlight style %q", c.Highlight.Style)
+	}
+	if _, ok := styles.Registry[c.Highlight.DarkStyle]; c.Highlight.DarkStyle != "" && !ok {
+		return fmt.Errorf("unknown highlight darkstyle %q", c.Highlight.DarkStyle)
+	}
+	if c.Highlight.TabWidth < 1 {
+		return fmt.Errorf("highlight tabwidth must be at least 1, got %d", c.Highlight.TabWidth)
+	}
+	if c.TOC.MinLevel < 1 || c.TOC.MaxLevel > 6 || c.TOC.MinLevel > c.TOC.MaxLevel {
+		return fmt.Errorf("toc levels must be between 1 and 6, got %d to %d", c.TOC.MinLevel, c.TOC.MaxLevel)
+	}
+	if c.WPM < 1 {
+		return fmt.Errorf("wpm must be at least 1, got %d", c.WPM)
+	}
+	return nil
+}
+
+// markdown is a goldmark parser built from a markdownConfig.
+type markdown struct {
+	goldmark.Markdown
+	key    string // hash of the config, as different configs produces different output
+	toc    tocConfig
+	wpm    int
+	images *images // optional
+}
+
+func newMarkdown(conf markdownConfig, im *images) (*markdown, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	var imKey string
+	if im != nil {
+		imKey = im.key
+	}
+	b, err := json.Marshal([]interface{}{conf, imKey})
+	if err != nil {
+		return nil, err
+	}
+
+	var exts []goldmark.Extender
+	for _, e := range conf.Extensions {
+		exts = append(exts, markdownExtensions[e])
+	}
+	exts = append(exts, highlighting.NewHighlighting(
+		highlighting.WithStyle(conf.Highlight.Style),
+		highlighting.WithGuessLanguage(true),
+		highlighting.WithFormatOptions(
+			chromahtml.WithLineNumbers(conf.Highlight.LineNumbers),
+			chromahtml.LineNumbersInTable(true),
+			chromahtml.TabWidth(conf.Highlight.TabWidth),
+			chromahtml.WithClasses(conf.Highlight.Classes),
+		),
+	))
+
+	md := goldmark.New(
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+		),
+	)
+	return &markdown{md, hashStrings(string(b)), conf.TOC, conf.WPM, im}, nil
+}
+
+// defaultMarkdown returns a parser using the default config, for posts that wasn't loaded by a Generator.
+func defaultMarkdown() *markdown {
+	md, err := newMarkdown(defaultMarkdownConfig(), nil)
+	if err != nil {
+		panic(err) // The defaults are always valid
+	}
+	return md
+}
+
+// moreMarker splits a post's body, everything before it is used as the excerpt.
+var moreMarker = []byte("<!--more-->")
+
+// convert writes src as html to w and returns everything else that's derived from the body, like the table of
+// contents (built from the headings), word count and excerpt. Dir is the source dir of the post, used for finding
+// the images it links to.
+func (md *markdown) convert(src []byte, w io.Writer, dir string) (renderedBody, error) {
+	doc := md.Parser().Parse(gtext.NewReader(src))
+	var flat []TOCEntry
+	var linked []linkedImage
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if img, ok := n.(*ast.Image); ok && entering && md.images != nil && dir != "" {
+			if l, ok := md.images.setAttributes(img, dir); ok {
+				linked = append(linked, l)
+			}
+		}
+		h, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		if h.Level < md.toc.MinLevel || h.Level > md.toc.MaxLevel {
+			return ast.WalkSkipChildren, nil
+		}
+		e := TOCEntry{
+			Level: h.Level,
+			Text:  string(h.Text(src)),
+		}
+		if id, ok := h.AttributeString("id"); ok {
+			if b, ok := id.([]byte); ok {
+				e.Anchor = string(b)
+			}
+		}
+		flat = append(flat, e)
+		return ast.WalkSkipChildren, nil
+	})
+	if err != nil {
+		return renderedBody{}, err
+	}
+	if err := md.Renderer().Render(w, src, doc); err != nil {
+		return renderedBody{}, err
+	}
+
+	words := len(strings.Fields(plainText(src, doc)))
+	r := renderedBody{
+		TOC:         nestTOC(flat),
+		WordCount:   words,
+		ReadingTime: time.Duration(words) * time.Minute / time.Duration(md.wpm),
+		Images:      linked,
+	}
+	r.TOCHTML = renderTOC(r.TOC)
+
+	// The excerpt is either everything before the more marker or the first paragraph
+	var excerpt []ast.Node
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if isMoreMarker(src, n) {
+			break
+		}
+		excerpt = append(excerpt, n)
+	}
+	if len(excerpt) == doc.ChildCount() {
+		excerpt = nil
+		for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+			if n.Kind() == ast.KindParagraph {
+				excerpt = append(excerpt, n)
+				break
+			}
+		}
+	}
+	var buf bytes.Buffer
+	var text []string
+	for _, n := range excerpt {
+		if err := md.Renderer().Render(&buf, src, n); err != nil {
+			return renderedBody{}, err
+		}
+		text = append(text, plainText(src, n))
+	}
+	r.Excerpt = strings.TrimSpace(buf.String())
+	r.ExcerptText = strings.Join(strings.Fields(strings.Join(text, " ")), " ")
+	return r, nil
+}
+
+func isMoreMarker(src []byte, n ast.Node) bool {
+	if n.Kind() != ast.KindHTMLBlock {
+		return false
+	}
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		if bytes.Equal(bytes.TrimSpace(seg.Value(src)), moreMarker) {
+			return true
+		}
+	}
+	return false
+}
+
+// plainText returns the text of n and all it's children, without any markup.
+func plainText(src []byte, n ast.Node) string {
+	var buf bytes.Buffer
+	ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) { // #nosec G104
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch t := n.(type) {
+		case *ast.Text:
+			buf.Write(t.Segment.Value(src))
+			buf.WriteByte(' ')
+		case *ast.String:
+			buf.Write(t.Value)
+			buf.WriteByte(' ')
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				seg := lines.At(i)
+				buf.Write(seg.Value(src))
+			}
+			buf.WriteByte(' ')
+		}
+		return ast.WalkContinue, nil
+	})
+	return buf.String()
+}
+
+// nestTOC moves the entries into the Children of the closest previous entry with a smaller level.
+func nestTOC(flat []TOCEntry) []TOCEntry {
+	var list []TOCEntry
+	for i := 0; i < len(flat); {
+		e := flat[i]
+		j := i + 1
+		for j < len(flat) && flat[j].Level > e.Level {
+			j++
+		}
+		e.Children = nestTOC(flat[i+1 : j])
+		list = append(list, e)
+		i = j
+	}
+	return list
+}
+
+// renderTOC returns the table of contents as nested html lists.
+func renderTOC(toc []TOCEntry) string {
+	if len(toc) < 1 {
+		return ""
+	}
+	var buf strings.Builder
+	buf.WriteString("<ul>\n")
+	for _, e := range toc {
+		fmt.Fprintf(&buf, "<li><a href=\"#%s\">%s</a>", html.EscapeString(e.Anchor), html.EscapeString(e.Text))
+		if len(e.Children) > 0 {
+			buf.WriteString("\n" + renderTOC(e.Children))
+		}
+		buf.WriteString("</li>\n")
+	}
+	buf.WriteString("</ul>\n")
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// renderChromaCSS returns the stylesheet for the highlighted code blocks, when they're using css classes.
+func renderChromaCSS(conf highlightConfig) ([]byte, error) {
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(conf.LineNumbers),
+		chromahtml.LineNumbersInTable(true),
+		chromahtml.TabWidth(conf.TabWidth),
+	)
+	var buf bytes.Buffer
+	if err := formatter.WriteCSS(&buf, styles.Get(conf.Style)); err != nil {
+		return nil, err
+	}
+	if conf.DarkStyle != "" {
+		buf.WriteString("@media (prefers-color-scheme: dark) {\n")
+		if err := formatter.WriteCSS(&buf, styles.Get(conf.DarkStyle)); err != nil {
+			return nil, err
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes(), nil
+}
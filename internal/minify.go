@@ -0,0 +1,128 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+)
+
+// Media types of the files that can be minified, by their extensions
+var minifyTypes = map[string]string{
+	".html": "text/html",
+	".xml":  "text/xml",
+	".css":  "text/css",
+	".js":   "application/javascript",
+}
+
+// minifier removes any unnecessary whitespace and comments from html, xml, css and js files.
+// A nil *minifier is valid and doesn't change anything.
+type minifier struct {
+	m *minify.M
+}
+
+func newMinifier(enabled bool) *minifier {
+	if !enabled {
+		return nil
+	}
+	m := minify.New()
+	m.Add("text/html", &html.Minifier{
+		// Keep the pages readable by the live reload and older browsers
+		KeepDocumentTags:    true,
+		KeepEndTags:         true,
+		KeepDefaultAttrVals: true,
+	})
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", js.Minify)
+	m.AddFunc("text/xml", minifyXML)
+	return &minifier{m}
+}
+
+// minify returns the minified data, if rel has a known file type.
+func (mi *minifier) minify(rel string, data []byte) ([]byte, error) {
+	mediatype, ok := minifyTypes[strings.ToLower(filepath.Ext(rel))]
+	if mi == nil || !ok {
+		return data, nil
+	}
+	return mi.m.Bytes(mediatype, data)
+}
+
+// outputs minifies the data of all outputs with known file types, including copied files.
+func (mi *minifier) outputs(list []output) ([]output, error) {
+	if mi == nil {
+		return list, nil
+	}
+	for i, o := range list {
+		if _, ok := minifyTypes[strings.ToLower(filepath.Ext(o.rel))]; !ok {
+			continue
+		}
+		data := o.data
+		if o.copy != "" {
+			var err error
+			data, err = os.ReadFile(o.copy) // #nosec G304
+			if err != nil {
+				return nil, err
+			}
+		}
+		b, err := mi.minify(o.rel, data)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = output{rel: o.rel, data: b}
+	}
+	return list, nil
+}
+
+// minifyXML removes the comments and whitespace between the tags. Any other text is kept as is, unlike the xml
+// minifier from tdewolff/minify which would collapse the whitespace in the escaped html content of the feeds.
+func minifyXML(_ *minify.M, w io.Writer, r io.Reader, _ map[string]string) error {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	d := xml.NewDecoder(bytes.NewReader(src))
+	var buf bytes.Buffer
+	var last int64
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			_, err = w.Write(buf.Bytes())
+			return err
+		} else if err != nil {
+			return err
+		}
+		off := d.InputOffset()
+		switch t := t.(type) {
+		case xml.Comment:
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				buf.Write(src[last:off])
+			}
+		default:
+			buf.Write(src[last:off])
+		}
+		last = off
+	}
+}
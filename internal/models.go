@@ -16,8 +16,7 @@
 package internal
 
 import (
-	"bytes"
-	"os"
+	"fmt"
 	"path"
 	"path/filepath"
 	"sort"
@@ -25,43 +24,108 @@ import (
 	"time"
 )
 
-// Meta is a map of strings that allows you to insert custom data into your templates, like links and titles.
+// Meta is a map of values that allows you to insert custom data into your templates, like links and titles.
+// The values can be nested, like lists of links or maps of authors and so on.
 // See example/.meta.yaml and the example html templates for usage.
-type Meta map[string]string
+type Meta map[string]interface{}
+
+// str returns the value for key as a string, or an empty string if it's not set.
+func (m Meta) str(key string) string {
+	v, ok := m[key]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 
+// PostMeta contains the known fields from the meta data header of a `post.md`.
+type PostMeta struct {
+	// Title is the title of the post
+	Title string
+	// Published is the publishing date
+	Published time.Time
+	// Updated is an optional date for the latest update
+	Updated time.Time
+	// Short is an optional, short description for the post (see Post.Summary)
+	Short string
+	// Tags is a list of optional string tags
+	Tags []string
+	// Draft marks the post as unfinished and it won't be published
+	Draft bool
+	// Expires is an optional date when the post stops being published
+	Expires time.Time
+	// Series is the optional name of a series of posts, that this post is a part of
+	Series string
+	// SeriesOrder is the post's optional position in the series, parts without one comes last and ordered by date
+	SeriesOrder int `yaml:"series_order"`
+}
+
 // Post contains the meta data header from a `post.md`.
 type Post struct {
 	// filepaths
 	source string
 	rel    string
+	body   *postBody // shared between all copies of the post
 
-	Meta struct {
-		// Title is the title of the post
-		Title string
-		// Published is the publishing date
-		Published time.Time
-		// Short is a short description for the post
-		Short string
-		// Tags is a list of optional string tags
-		Tags []string
-	}
+	Meta PostMeta
+	// Params contains any other, custom fields from the header
+	Params map[string]interface{}
 }
 
-// Body parses the post's body and parses it as commonmark.
+// Body returns the post's body, parsed as commonmark.
+// It's only parsed once per run and then cached between runs, as long as the post doesn't change.
 func (p Post) Body() (string, error) {
-	f, err := os.Open(p.source) // #nosec G304
-	if err != nil {
-		return "", err
+	r, err := p.getBody()
+	return r.HTML, err
+}
+
+func (p Post) getBody() (renderedBody, error) {
+	if p.body == nil {
+		return (&postBody{source: p.source}).get() // Not loaded by a Generator
 	}
-	// It's only being read, should be safe to ignore Close() errors
-	defer f.Close() // #nosec G307
-	var buf bytes.Buffer
-	if err := scanBody(f, &buf); err != nil {
-		return "", err
+	return p.body.get()
+}
+
+// TableOfContents returns the headings of the post's body, nested by their levels.
+func (p Post) TableOfContents() ([]TOCEntry, error) {
+	r, err := p.getBody()
+	return r.TOC, err
+}
+
+// TableOfContentsHTML returns the table of contents as nested html lists, linking to each heading.
+func (p Post) TableOfContentsHTML() (string, error) {
+	r, err := p.getBody()
+	return r.TOCHTML, err
+}
+
+// WordCount returns the number of words in the post's body.
+func (p Post) WordCount() (int, error) {
+	r, err := p.getBody()
+	return r.WordCount, err
+}
+
+// ReadingTime returns the estimated time it takes to read the post, see the "wpm" markdown setting.
+func (p Post) ReadingTime() (time.Duration, error) {
+	r, err := p.getBody()
+	return r.ReadingTime, err
+}
+
+// Excerpt returns the start of the post's body as html, either everything before a "<!--more-->" line or the
+// first paragraph.
+func (p Post) Excerpt() (string, error) {
+	r, err := p.getBody()
+	return r.Excerpt, err
+}
+
+// Summary returns the short description from the header, or the excerpt as plain text if the post doesn't have one.
+func (p Post) Summary() (string, error) {
+	if p.Meta.Short != "" {
+		return p.Meta.Short, nil
 	}
-	return buf.String(), nil
+	r, err := p.getBody()
+	return r.ExcerptText, err
 }
 
 // Link returns a relative http link to the post.
@@ -82,12 +146,68 @@ func sortPosts(posts []Post) {
 	})
 }
 
+// relatedPosts returns the other posts sharing any tags with cur, with the most shared tags first and then in the
+// same order as posts.
+func relatedPosts(posts []Post, cur Post) []Post {
+	tags := make(map[string]bool, len(cur.Meta.Tags))
+	for _, t := range cur.Meta.Tags {
+		tags[t] = true
+	}
+	var list []Post
+	shared := make(map[string]int)
+	for _, p := range posts {
+		if p.rel == cur.rel {
+			continue
+		}
+		for _, t := range p.Meta.Tags {
+			if tags[t] {
+				shared[p.rel]++
+			}
+		}
+		if shared[p.rel] > 0 {
+			list = append(list, p)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return shared[list[i].rel] > shared[list[j].rel]
+	})
+	return list
+}
+
+// TOCEntry is a heading in a post's table of contents.
+type TOCEntry struct {
+	// Level is the heading level, from 1 to 6
+	Level int
+	// Text is the plain text of the heading
+	Text string
+	// Anchor is the heading's id, for linking to it with "#anchor"
+	Anchor string
+	// Children are the following headings with larger levels
+	Children []TOCEntry
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 
 // Tag contains a list of posts it was tagged in.
 type Tag struct {
 	Title string
 	Posts []Post
+
+	slug string // unique dir name, see pathSlug()
+}
+
+func (t Tag) rel(name string) string {
+	return filepath.Join(tagsDir, t.slug, name)
+}
+
+// Link returns a relative http link to the tag's page, if the site has a tag template.
+func (t Tag) Link() string {
+	return path.Join("/", filepath.ToSlash(t.rel(postDest)))
+}
+
+// FeedLink returns a relative http link to the tag's feed, if the site has a tag feed template.
+func (t Tag) FeedLink() string {
+	return path.Join("/", filepath.ToSlash(t.rel(tagFeedDest)))
 }
 
 func sortTags(tags []Tag) {
@@ -110,7 +230,149 @@ func readTags(posts []Post) []Tag {
 		tags = append(tags, Tag{
 			Title: strings.Title(t),
 			Posts: ps,
+			slug:  pathSlug(t),
 		})
 	}
 	return tags
 }
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Series contains all the parts of a series of posts, in order.
+type Series struct {
+	Title string
+	Posts []Post
+
+	slug string // unique dir name, see pathSlug()
+}
+
+func (s Series) rel(name string) string {
+	return filepath.Join(seriesDir, s.slug, name)
+}
+
+// Link returns a relative http link to the series' page, if the site has a series template.
+func (s Series) Link() string {
+	return path.Join("/", filepath.ToSlash(s.rel(postDest)))
+}
+
+// index returns the position of the post in the series, or -1 if it's not a part of it.
+func (s Series) index(p Post) int {
+	for i := range s.Posts {
+		if s.Posts[i].rel == p.rel {
+			return i
+		}
+	}
+	return -1
+}
+
+func sortSeries(series []Series) {
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Title < series[j].Title
+	})
+}
+
+// readSeries groups the posts by their series names, ignoring case. The parts with a series order comes first,
+// sorted by their order, and the rest are ordered by date.
+func readSeries(posts []Post) []Series {
+	seriesMap := make(map[string][]Post)
+	for _, p := range posts {
+		if p.Meta.Series != "" {
+			name := strings.ToLower(p.Meta.Series)
+			seriesMap[name] = append(seriesMap[name], p)
+		}
+	}
+
+	var series []Series
+	for name, ps := range seriesMap {
+		sort.SliceStable(ps, func(i, j int) bool {
+			// SORT ORDER: parts with a series order first, then the oldest date first
+			o1, o2 := ps[i].Meta.SeriesOrder, ps[j].Meta.SeriesOrder
+			switch {
+			case o1 > 0 && o2 > 0 && o1 != o2:
+				return o1 < o2
+			case o1 > 0 && o2 < 1:
+				return true
+			case o1 < 1 && o2 > 0:
+				return false
+			}
+			return ps[i].Meta.Published.Before(ps[j].Meta.Published)
+		})
+		series = append(series, Series{
+			Title: ps[0].Meta.Series,
+			Posts: ps,
+			slug:  pathSlug(name),
+		})
+	}
+	return series
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Paginator splits a list of posts into multiple pages, see the "paginate" template func.
+type Paginator struct {
+	// Page is the current page number, starting at 1
+	Page int
+	// TotalPages is the total number of pages
+	TotalPages int
+	// PerPage is the max number of posts per page
+	PerPage int
+	// Posts is the list of posts on the current page
+	Posts []Post
+	// Prev is a relative http link to the previous page, if there's one
+	Prev string
+	// Next is a relative http link to the next page, if there's one
+	Next string
+
+	rel string // relative destination path of the first page
+}
+
+func newPaginator(rel string, page int) *Paginator {
+	return &Paginator{
+		Page:       page,
+		TotalPages: 1,
+		rel:        rel,
+	}
+}
+
+// pageRel returns the relative destination path for page n, like "/page/2/index.html" for the first page
+// "/index.html".
+func (p *Paginator) pageRel(n int) string {
+	if n < 2 {
+		return p.rel
+	}
+	return filepath.Join(filepath.Dir(p.rel), "page", fmt.Sprint(n), filepath.Base(p.rel))
+}
+
+// PageLink returns a relative http link to page n.
+func (p *Paginator) PageLink(n int) string {
+	return path.Join("/", filepath.ToSlash(p.pageRel(n)))
+}
+
+func (p *Paginator) paginate(perPage int, posts []Post) (*Paginator, error) {
+	if perPage < 1 {
+		return nil, fmt.Errorf("paginate: posts per page must be at least 1")
+	}
+	p.PerPage = perPage
+	p.TotalPages = (len(posts) + perPage - 1) / perPage
+	if p.TotalPages < 1 {
+		p.TotalPages = 1
+	}
+
+	start, end := (p.Page-1)*perPage, p.Page*perPage
+	if start > len(posts) {
+		start = len(posts)
+	}
+	if end > len(posts) {
+		end = len(posts)
+	}
+	p.Posts = posts[start:end]
+
+	p.Prev, p.Next = "", ""
+	if p.Page > 1 {
+		p.Prev = p.PageLink(p.Page - 1)
+	}
+	if p.Page < p.TotalPages {
+		p.Next = p.PageLink(p.Page + 1)
+	}
+	return p, nil
+}
@@ -18,57 +18,94 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	chromahtml "github.com/alecthomas/chroma/formatters/html"
-	"github.com/yuin/goldmark"
-	highlighting "github.com/yuin/goldmark-highlighting"
-	"github.com/yuin/goldmark/extension"
-	"github.com/yuin/goldmark/parser"
+	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v2"
 )
 
-var markdownParser = goldmark.New(
-	goldmark.WithExtensions(
-		extension.GFM,
-		extension.DefinitionList,
-		//emoji.New(
-		//emoji.WithRenderingMethod(emoji.Entity),
-		//),
-		highlighting.NewHighlighting(
-			// All available styles can be found at: https://github.com/alecthomas/chroma/tree/master/styles
-			// (and an outdated gallery at: https://xyproto.github.io/splash/docs/all.html)
-			highlighting.WithStyle("monokai"),
-			highlighting.WithGuessLanguage(true),
-			highlighting.WithFormatOptions(
-				chromahtml.WithLineNumbers(true),
-				chromahtml.LineNumbersInTable(true), // Copy-friendly lines
-				chromahtml.TabWidth(8),
-				// Enable this to get rid of inline css styles and add classes you can style yourself
-				//chromahtml.WithClasses(true),
-			),
-		),
-	),
-	goldmark.WithParserOptions(
-		parser.WithAutoHeadingID(),
-	),
-)
-
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 
 const (
-	maxHeaderSize int64 = 1000    // 1kb, gives plenty of bytes for long titles, shorts and a lot of tags.
+	maxHeaderSize int64 = 64000   // 64kb, gives plenty of bytes for long titles, shorts, tags and custom fields.
 	maxFileSize   int64 = 5000000 // 5mb, barely enough for shakespear a la 80 hours of text (with 200wpm)
 )
 
-var headerSeparator = []byte("---") // map, slice and array can't be const
+// headerFormat describes how a header starts and ends, and how it should be decoded.
+type headerFormat struct {
+	start  []byte
+	end    []byte
+	json   bool // the start and end lines are part of the json object
+	decode func(b []byte, v interface{}, line int) error
+}
+
+var headerFormats = []headerFormat{ // map, slice and array can't be const
+	{[]byte("---"), []byte("---"), false, decodeYAML},
+	{[]byte("+++"), []byte("+++"), false, decodeTOML},
+	{[]byte("{"), []byte("}"), true, decodeJSON},
+}
+
+func (f *headerFormat) isEnd(line []byte) bool {
+	return bytes.HasPrefix(line, f.end)
+}
+
+type lineKind int
+
+const (
+	lineBody lineKind = iota
+	lineSeparator
+	lineHeader
+)
+
+// headerSplit keeps track of where the header starts and ends while scanning a post, line by line.
+// The format of the header is picked from the first non-empty line.
+type headerSplit struct {
+	format *headerFormat
+	ended  bool
+	lines  int // number of scanned lines
+	first  int // line number of the first non-empty header line
+}
 
-func isSeparator(line []byte) bool {
-	return bytes.HasPrefix(line, headerSeparator)
+func (h *headerSplit) next(line []byte) lineKind {
+	h.lines++
+	switch {
+	case h.ended:
+		return lineBody
+	case h.format == nil && len(bytes.TrimSpace(line)) < 1:
+		return lineSeparator // Ignore any empty lines before the header
+	case h.format == nil:
+		for i := range headerFormats {
+			if bytes.HasPrefix(line, headerFormats[i].start) {
+				h.format = &headerFormats[i]
+			}
+		}
+		if h.format == nil {
+			h.ended = true // There's no header
+			return lineBody
+		}
+		if !h.format.json {
+			return lineSeparator
+		}
+		h.ended = bytes.HasSuffix(bytes.TrimSpace(line), h.format.end) // A single line json object
+	case h.format.isEnd(line):
+		h.ended = true
+		if !h.format.json {
+			return lineSeparator
+		}
+	}
+	if h.first == 0 && len(bytes.TrimSpace(line)) > 0 {
+		h.first = h.lines
+	}
+	return lineHeader
 }
 
 type scanCheck func([]byte) ([]byte, bool) // Return true when you want to stop the scanning
@@ -94,53 +131,248 @@ func scan(f io.Reader, maxSize int64, check scanCheck) ([]byte, error) {
 	return bytes.TrimSpace(buf.Bytes()), nil
 }
 
+// scanHeader decodes the yaml, toml or json header into v. Errors are returned as FileError (or Errors of FileError),
+// with line numbers matching the lines in r.
 func scanHeader(r io.Reader, v interface{}) error {
-	separators := 0
-	b, err := scan(r, maxHeaderSize, func(line []byte) ([]byte, bool) {
-		if isSeparator(line) {
-			separators++
-			if separators == 2 {
-				return nil, true
-			}
-			return nil, false
+	var h headerSplit
+	lr := &io.LimitedReader{R: r, N: maxHeaderSize}
+	b, err := scan(lr, maxHeaderSize, func(line []byte) ([]byte, bool) {
+		switch h.next(line) {
+		case lineHeader:
+			return line, false
+		case lineSeparator:
+			return nil, h.ended
 		}
-		return line, false
+		return nil, true
 	})
 	switch {
 	case err != nil:
 		return err
+	case h.format != nil && !h.ended && lr.N < 1:
+		return &FileError{Line: 1, Err: fmt.Errorf("header exceeds %d bytes", maxHeaderSize)}
+	case h.format == nil, !h.ended:
+		return &FileError{Line: 1, Err: fmt.Errorf("missing separator lines")}
 	case len(b) < 1:
-		return fmt.Errorf("missing header")
-	case separators != 2:
-		return fmt.Errorf("missing separator lines")
+		return &FileError{Line: 1, Err: fmt.Errorf("missing header")}
 	}
-	return yaml.UnmarshalStrict(b, v)
+	return h.format.decode(b, v, h.first)
 }
 
-func scanBody(r io.Reader, w io.Writer) error {
-	separators := 0
+// scanBody writes the post's body as html to w and returns everything else derived from it, with an empty HTML.
+// Dir is the source dir of the post, or empty if there's none.
+func scanBody(r io.Reader, w io.Writer, md *markdown, dir string) (renderedBody, error) {
+	var h headerSplit
 	b, err := scan(r, maxFileSize, func(line []byte) ([]byte, bool) {
-		if separators == 2 {
+		if h.next(line) == lineBody {
 			return line, false
 		}
-		if isSeparator(line) {
-			separators++
-		}
 		return nil, false
 	})
 	switch {
 	case err != nil:
-		return err
+		return renderedBody{}, err
+	case h.format == nil, !h.ended:
+		return renderedBody{}, fmt.Errorf("missing separator lines")
 	case len(b) < 1:
-		return fmt.Errorf("missing body")
-	case separators != 2:
-		return fmt.Errorf("missing separator lines")
+		return renderedBody{}, fmt.Errorf("missing body")
+	}
+	return md.convert(b, w, dir)
+}
+
+// decodeYAML decodes a yaml header, where line is the first line of the header in the post.
+func decodeYAML(b []byte, v interface{}, line int) error {
+	if err := yaml.UnmarshalStrict(b, v); err != nil {
+		errs := yamlErrors(err, line-1).(Errors)
+		for _, e := range errs {
+			// Some errors doesn't have a line number, like invalid dates, so point at the start of the header
+			if fe := e.(*FileError); fe.Line < 1 {
+				fe.Line = line
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+func decodeTOML(b []byte, v interface{}, line int) error {
+	m := make(map[string]interface{})
+	if err := toml.Unmarshal(b, &m); err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			// Strip the line number, it's wrong as the toml decoder doesn't see the whole post
+			msg := strings.TrimPrefix(pe.Error(), fmt.Sprintf("toml: line %d", pe.Position.Line))
+			msg = strings.TrimPrefix(strings.TrimSpace(msg), ": ")
+			return &FileError{Line: pe.Position.Line + line - 1, Err: errors.New(msg)}
+		}
+		return &FileError{Line: line, Err: err}
+	}
+	return remarshal(m, v, line)
+}
+
+func decodeJSON(b []byte, v interface{}, line int) error {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		var offset int64
+		var se *json.SyntaxError
+		var te *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &se):
+			offset = se.Offset
+		case errors.As(err, &te):
+			offset = te.Offset
+		}
+		if offset > int64(len(b)) {
+			offset = int64(len(b))
+		}
+		n := bytes.Count(b[:offset], []byte("\n"))
+		return &FileError{Line: line + n, Err: err}
+	}
+	return remarshal(m, v, line)
+}
+
+// Date layouts accepted for the known date fields, in toml or json headers
+var dateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// remarshal decodes the toml or json header m into v, by converting it to yaml first, so all header formats uses
+// the same strict decoding and validation.
+func remarshal(m map[string]interface{}, v interface{}, line int) error {
+	// Json has no dates and yaml can't decode quoted strings as dates, so give it a helping hand
+	for _, k := range []string{"published", "updated", "expires"} {
+		s, ok := m[k].(string)
+		if !ok {
+			continue
+		}
+		for _, l := range dateLayouts {
+			if t, err := time.Parse(l, s); err == nil {
+				m[k] = t
+				break
+			}
+		}
+	}
+
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return &FileError{Line: line, Err: err}
 	}
-	return markdownParser.Convert(b, w)
+	if err := yaml.UnmarshalStrict(b, v); err != nil {
+		// The line numbers from the converted yaml doesn't match the original header
+		errs := yamlErrors(err, 0).(Errors)
+		for _, e := range errs {
+			e.(*FileError).Line = line
+		}
+		return errs
+	}
+	return nil
+}
+
+// renderedBody is the result of converting a post's body, as stored in the cache.
+type renderedBody struct {
+	HTML        string
+	TOC         []TOCEntry
+	TOCHTML     string
+	WordCount   int
+	ReadingTime time.Duration
+	Excerpt     string
+	ExcerptText string
+	Images      []linkedImage // the images in the body, as their sizes are used for the attributes
+}
+
+// postBody converts a post's body the first time it's requested, reusing the result from the cache if the post
+// hasn't changed since it was converted.
+type postBody struct {
+	source string
+	cache  *cache
+	md     *markdown
+
+	once sync.Once
+	body renderedBody
+	err  error
+}
+
+func (b *postBody) get() (renderedBody, error) {
+	b.once.Do(func() {
+		b.body, b.err = b.render()
+	})
+	return b.body, b.err
+}
+
+func (b *postBody) render() (renderedBody, error) {
+	src, err := os.ReadFile(b.source)
+	if err != nil {
+		return renderedBody{}, err
+	}
+	md := b.md
+	if md == nil {
+		md = defaultMarkdown()
+	}
+	key := hashStrings(Version, md.key, string(src))
+	if data, ok := b.cache.get("body", key); ok {
+		var r renderedBody
+		if err := json.Unmarshal(data, &r); err == nil && !imagesChanged(r.Images) {
+			return r, nil
+		}
+		// Convert it again if the cached file was damaged or any of the images has changed
+	}
+
+	var buf bytes.Buffer
+	r, err := scanBody(bytes.NewReader(src), &buf, md, filepath.Dir(b.source))
+	if err != nil {
+		return renderedBody{}, err
+	}
+	r.HTML = buf.String()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return renderedBody{}, err
+	}
+	// The cache is only an optimisation, a broken cache dir shouldn't fail the page
+	b.cache.put("body", key, data) // #nosec G104
+	return r, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 
+// postHeader is used for decoding the header, as only the unknown fields ends up in Params.
+type postHeader struct {
+	PostMeta `yaml:",inline"`
+	Params   map[string]interface{} `yaml:",inline"`
+}
+
+// cleanYAML converts the maps decoded by yaml to use string keys, so they can be used by both templates and json.
+func cleanYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = cleanYAML(v)
+		}
+		return m
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = cleanYAML(v)
+		}
+		return t
+	case []interface{}:
+		for i := range t {
+			t[i] = cleanYAML(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+// missingField returns the name of the first required field that's missing from the header, if any.
+func missingField(m PostMeta) string {
+	switch {
+	case len(m.Title) < 1:
+		return "title"
+	case m.Published.IsZero():
+		return "published"
+	case len(m.Tags) < 1:
+		return "tags"
+	}
+	return ""
+}
+
 func readPost(path, rel string) (Post, error) {
 	f, err := os.Open(path) // #nosec G304
 	if err != nil {
@@ -153,22 +385,20 @@ func readPost(path, rel string) (Post, error) {
 		source: path,
 		rel:    rel,
 	}
-	if err := scanHeader(f, &post.Meta); err != nil {
-		return Post{}, fmt.Errorf("read head: %s", err)
+	var header postHeader
+	if err := scanHeader(f, &header); err != nil {
+		return Post{}, withPath(path, err)
+	}
+	post.Meta = header.PostMeta
+	if len(header.Params) > 0 {
+		post.Params = cleanYAML(header.Params).(map[string]interface{})
 	}
 
 	// TODO: verify the yaml parser trims whitespace properly
 	// TODO: also do fuzz testing
 
-	switch {
-	case len(post.Meta.Title) < 1:
-		return Post{}, fmt.Errorf("header is missing the title field")
-	case post.Meta.Published.IsZero():
-		return Post{}, fmt.Errorf("header is missing the published field")
-	case len(post.Meta.Short) < 1:
-		return Post{}, fmt.Errorf("header is missing the short field")
-	case len(post.Meta.Tags) < 1:
-		return Post{}, fmt.Errorf("header is missing the tags field")
+	if missing := missingField(post.Meta); missing != "" {
+		return Post{}, &FileError{Path: path, Line: 1, Err: fmt.Errorf("header is missing the %s field", missing)}
 	}
 
 	post.Meta.Title = strings.Title(post.Meta.Title)
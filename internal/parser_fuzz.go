@@ -24,20 +24,17 @@ import (
 func Fuzz(data []byte) int {
 	// I'm running both scanners in the same func like this, as it makes is easier for now to run the fuzzer and
 	// friends as a single instance.
+	// The header format (yaml, toml or json) is picked by scanHeader, so the corpus should contain all of them.
 	body := bytes.NewBuffer(data)
 
-	var post Post
-	err := scanHeader(body, &post)
-	if err != nil ||
-		len(post.Meta.Title) < 1 ||
-		post.Meta.Published.IsZero() ||
-		len(post.Meta.Short) < 1 ||
-		len(post.Meta.Tags) < 1 {
+	var header postHeader
+	err := scanHeader(body, &header)
+	if err != nil || missingField(header.PostMeta) != "" {
 		return 0
 	}
 
 	var buf bytes.Buffer
-	if err := scanBody(body, &buf); err != nil {
+	if _, err := scanBody(bytes.NewReader(data), &buf, defaultMarkdown(), ""); err != nil {
 		return 0
 	}
 
@@ -0,0 +1,86 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// errorLine returns the line number of the first FileError in err.
+func errorLine(err error) int {
+	var errs Errors
+	if errors.As(err, &errs) && len(errs) > 0 {
+		err = errs[0]
+	}
+	var fe *FileError
+	if errors.As(err, &fe) {
+		return fe.Line
+	}
+	return -1
+}
+
+func TestScanHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		title string // expected title, if there's no error
+		line  int    // expected line of the error, 0 if there's none
+		err   string // expected part of the error message
+	}{
+		{"yaml", "---\ntitle: Yaml\npublished: 2020-01-01\ntags:\n- a\n---\n\nbody\n", "Yaml", 0, ""},
+		{"yaml after empty lines", "\n\n---\ntitle: Yaml\npublished: 2020-01-01\ntags: [a]\n---\nbody\n", "Yaml", 0, ""},
+		{"toml", "+++\ntitle = \"Toml\"\npublished = 2020-01-01\ntags = [\"a\"]\n+++\n\nbody\n", "Toml", 0, ""},
+		{"json", "{\n\"title\": \"Json\",\n\"published\": \"2020-01-01\",\n\"tags\": [\"a\"]\n}\n\nbody\n", "Json", 0, ""},
+		{"single line json", `{"title": "Json", "published": "2020-01-01", "tags": ["a"]}` + "\nbody\n", "Json", 0, ""},
+		{"no header", "just a body\n", "", 1, "missing separator lines"},
+		{"missing yaml end", "---\ntitle: Yaml\npublished: 2020-01-01\n\nbody\n", "", 1, "missing separator lines"},
+		{"missing toml end", "+++\ntitle = \"Toml\"\n\nbody\n", "", 1, "missing separator lines"},
+		{"missing json end", "{\n\"title\": \"Json\"\n\nbody\n", "", 1, "missing separator lines"},
+		{"empty header", "---\n---\nbody\n", "", 1, "missing header"},
+		{"yaml type error", "\n---\ntitle: Yaml\ntags:\n  a: b\n---\nbody\n", "", 5, "cannot unmarshal"},
+		{"yaml date error", "\n---\ntitle: Yaml\npublished: notadate\n---\nbody\n", "", 3, "parsing time"},
+		{"toml syntax error", "+++\ntitle = \"Toml\"\nfoo = = 1\ntags = [\"a\"]\n+++\nbody\n", "", 3, "expected value"},
+		{"json syntax error", "\n{\n\"title\": \"Json\",\n\"tags\": [\"a\",]\n}\nbody\n", "", 4, "invalid character"},
+		{"json type error", "{\n\"title\": \"Json\",\n\"tags\": \"a\"\n}\nbody\n", "", 1, "cannot unmarshal"},
+		{"too large", "---\ntitle: " + strings.Repeat("a", int(maxHeaderSize)) + "\n---\nbody\n", "", 1, "header exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h postHeader
+			err := scanHeader(strings.NewReader(tt.src), &h)
+			if tt.line == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if h.Title != tt.title {
+					t.Errorf("got title %q, want %q", h.Title, tt.title)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %q at line %d", tt.err, tt.line)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %q, want %q", err, tt.err)
+			}
+			if l := errorLine(err); l != tt.line {
+				t.Errorf("got error at line %d, want %d: %s", l, tt.line, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reloadPath     string        = "/.dumblog/reload"
+	reloadInterval time.Duration = 500 * time.Millisecond
+)
+
+// Tiny script injected into all html pages, it reloads the page when the server tells it the site was regenerated.
+var reloadScript = []byte(`<script>new EventSource("` + reloadPath + `").onmessage = function() { location.reload(); };</script>`)
+
+const errorPage string = `<!doctype html>
+<html lang="en">
+<head>
+        <meta charset="utf-8">
+        <title>Error | dumblog</title>
+</head>
+<body style="margin:0;background:#222;color:#eee;font-family:monospace">
+        <div style="padding:2em">
+                <h1 style="color:#f66">Error regenerating the site</h1>
+                <pre style="white-space:pre-wrap">%s</pre>
+        </div>
+</body>
+</html>`
+
+// Server regenerates a site each time its template dir is changed and serves the output dir, while making any open
+// browser pages reload themselves.
+type Server struct {
+	src  string
+	dst  string
+	opts Options
+
+	mu      sync.Mutex
+	err     error // from the latest regeneration
+	clients map[chan struct{}]bool
+}
+
+// NewServer returns a new *Server that reads the templates from src and writes the site to dst.
+func NewServer(src, dst string, opts Options) *Server {
+	return &Server{
+		src:     src,
+		dst:     dst,
+		opts:    opts,
+		clients: make(map[chan struct{}]bool),
+	}
+}
+
+// Run generates the site and then serves it on addr, while watching for changes.
+// Any errors from generating the site are shown in the browser instead.
+func (s *Server) Run(addr string, logf func(string, ...interface{})) error {
+	s.update(logf)
+	go s.watch(logf)
+	return http.ListenAndServe(addr, s)
+}
+
+func (s *Server) update(logf func(string, ...interface{})) {
+	gen := New(s.opts)
+	err := gen.ReadTemplate(s.src)
+	if err == nil {
+		err = gen.ExecuteTemplate(s.dst)
+	}
+	if err != nil {
+		logf("Error updating %q:\n%s", s.src, err)
+	} else {
+		logf("Wrote %s", s.dst)
+	}
+
+	s.mu.Lock()
+	s.err = err
+	for c := range s.clients {
+		select {
+		case c <- struct{}{}:
+		default: // Client already has a pending reload
+		}
+	}
+	s.mu.Unlock()
+}
+
+// watch polls the template dir for any changed files, it's dumb but doesn't require any extra dependencies.
+func (s *Server) watch(logf func(string, ...interface{})) {
+	last := s.snapshot()
+	for range time.Tick(reloadInterval) {
+		cur := s.snapshot()
+		if cur == last {
+			continue
+		}
+		last = cur
+		s.update(logf)
+	}
+}
+
+// snapshot returns a string representing the current state of all files in the template dir.
+func (s *Server) snapshot() string {
+	var list []string
+	err := filepath.WalkDir(s.src, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		list = append(list, path, fi.ModTime().String(), fmt.Sprint(fi.Size()))
+		return nil
+	})
+	if err != nil {
+		// Might be in the middle of a file being saved, this will trigger another update later on
+		list = append(list, err.Error())
+	}
+	return hashStrings(list...)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// ServeHTTP serves the files from the output dir, injecting the reload script into html pages.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == reloadPath {
+		s.serveReload(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, errorPage, html.EscapeString(err.Error()))
+		w.Write(reloadScript) // #nosec G104
+		return
+	}
+
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		p = path.Join(p, "index.html")
+	}
+	if path.Ext(p) != ".html" {
+		StaticHandler(s.dst).ServeHTTP(w, r)
+		return
+	}
+	b, err := os.ReadFile(filepath.Join(s.dst, filepath.FromSlash(p))) // #nosec G304
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(injectScript(b)) // #nosec G104
+}
+
+func injectScript(page []byte) []byte {
+	i := bytes.LastIndex(page, []byte("</body>"))
+	if i < 0 {
+		return append(page, reloadScript...)
+	}
+	var buf bytes.Buffer
+	buf.Write(page[:i])
+	buf.Write(reloadScript)
+	buf.Write(page[i:])
+	return buf.Bytes()
+}
+
+// serveReload keeps the connection open and sends Server-Sent Events each time the site has been regenerated.
+func (s *Server) serveReload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+		}
+	}
+}
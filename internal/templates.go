@@ -20,6 +20,7 @@ import (
 	"embed"
 	"fmt"
 	html "html/template"
+	"io"
 	"io/fs"
 	"net/url"
 	"os"
@@ -27,7 +28,11 @@ import (
 	"reflect"
 	"strings"
 	text "text/template"
+	"text/template/parse"
 	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
 )
 
 // Params is a struct holding all available meta data you can use in a template.
@@ -40,8 +45,12 @@ type Params struct {
 	Posts []Post
 	// Tags is a list of parsed Tag
 	Tags []Tag
-	// Pages is a list of all html pages that will be written
+	// Series is a list of all series of posts
+	Series []Series
+	// Pages is a list of all html pages that will be written, including the extra pages from "paginate"
 	Pages []string
+	// Paginator is the current page, when the template is split into multiple pages using the "paginate" func
+	Paginator *Paginator
 }
 
 // PostParams is struct similar to Params, but it also holds the currently active post.
@@ -50,6 +59,65 @@ type PostParams struct {
 
 	// Current is the active post being written, otherwise it's nil
 	Current Post
+	// Prev is the previous, older post in the same dir as Current (see "postsbydir"), nil for the oldest post
+	Prev *Post
+	// Next is the next, newer post in the same dir as Current, nil for the latest post
+	Next *Post
+	// Related is a list of other posts sharing any tags with Current, with the most shared tags first
+	Related []Post
+	// CurrentSeries is the series Current is a part of, otherwise it's nil
+	CurrentSeries *Series
+	// SeriesIndex is the position of Current in CurrentSeries.Posts, starting at 0
+	SeriesIndex int
+}
+
+func newPostParams(params Params, cur Post) PostParams {
+	pp := PostParams{
+		Params:  params,
+		Current: cur,
+		Related: relatedPosts(params.Posts, cur),
+	}
+	for i := range params.Series {
+		if n := params.Series[i].index(cur); n >= 0 {
+			pp.CurrentSeries = &params.Series[i]
+			pp.SeriesIndex = n
+		}
+	}
+	// Posts are sorted with the latest first
+	var dir []*Post
+	for i := range params.Posts {
+		if firstDir(params.Posts[i].rel) == firstDir(cur.rel) {
+			dir = append(dir, &params.Posts[i])
+		}
+	}
+	for i, p := range dir {
+		if p.rel != cur.rel {
+			continue
+		}
+		if i > 0 {
+			pp.Next = dir[i-1]
+		}
+		if i < len(dir)-1 {
+			pp.Prev = dir[i+1]
+		}
+	}
+	return pp
+}
+
+// TagParams is struct similar to Params, but it also holds the currently active tag.
+type TagParams struct {
+	Params
+
+	// Current is the active tag being written
+	Current Tag
+}
+
+// SeriesParams is struct similar to Params, but it also holds the currently active series.
+type SeriesParams struct {
+	Params
+
+	// Current is the active series being written
+	Current Series
 }
 
 // TemplateFuncs contains helper functions for the templates
@@ -83,6 +151,15 @@ var TemplateFuncs = text.FuncMap{
 	"safehtml": func(s string) html.HTML {
 		return html.HTML(s) // #nosec G203
 	},
+	"xmlescape": func(v interface{}) string {
+		if h, ok := v.(html.HTML); ok {
+			return string(h) // Trusted by safehtml
+		}
+		return text.HTMLEscapeString(fmt.Sprint(v))
+	},
+	"paginate": func(perPage int, posts []Post) (*Paginator, error) {
+		return nil, fmt.Errorf("paginate can't be used in this template")
+	},
 	"postslimit": func(max int, posts []Post) []Post {
 		l := len(posts)
 		if l > max {
@@ -100,7 +177,22 @@ var TemplateFuncs = text.FuncMap{
 		return list
 	},
 	"slugify": func(s string) string {
-		return url.PathEscape(strings.ReplaceAll(strings.ToLower(s), " ", "_"))
+		return url.PathEscape(slugName(s))
+	},
+	"taglink": func(tag string) string {
+		return Tag{slug: pathSlug(strings.ToLower(tag))}.Link()
+	},
+	"chromacss": func() string {
+		return "" // Set by the generator, when highlighting uses css classes
+	},
+	"srcset": func(link string) string {
+		return "" // Set by the generator, when images are resized
+	},
+	"asset": func(link string) (string, error) {
+		return link, nil // Set by the generator
+	},
+	"integrity": func(link string) (string, error) {
+		return "", nil // Set by the generator
 	},
 	"isset": func(field string, v interface{}) bool {
 		// Stolen from: https://stackoverflow.com/a/34703243
@@ -115,6 +207,40 @@ var TemplateFuncs = text.FuncMap{
 	},
 }
 
+// slug returns a lower case version of s, with spaces replaced by underscores and any other characters that doesn't
+// belong in a dir name removed.
+func slug(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ':
+			return '_'
+		case r == '-', r == '_', unicode.IsLetter(r), unicode.IsDigit(r):
+			return r
+		}
+		return -1
+	}, strings.ToLower(s))
+}
+
+// slugName returns s in lower case and with spaces replaced by underscores, the same as the "slugify" func does
+// before escaping it for urls.
+func slugName(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), " ", "_")
+}
+
+// pathSlug returns a slug of s that can be used as a dir name. A short hash of s is added if the slug had to drop
+// or change any other characters than spaces, so different names can't share the same dir (like "c" and "c++").
+func pathSlug(s string) string {
+	sl := slug(s)
+	if sl != "" && !strings.Contains(s, "_") && sl == strings.ReplaceAll(s, " ", "_") {
+		return sl
+	}
+	h := hashStrings(s)[:8]
+	if sl == "" {
+		return h
+	}
+	return sl + "-" + h
+}
+
 // CreateTemplate creates an example dir with some template files you can use.
 func CreateTemplate(dst, src string, content embed.FS) error {
 	return fs.WalkDir(content, src, func(path string, de fs.DirEntry, err error) error {
@@ -132,34 +258,285 @@ func CreateTemplate(dst, src string, content embed.FS) error {
 	})
 }
 
-////////////////////////////////////////////////////////////////////////////////////////////////////
+const newPostHeader string = `---
+title: %s
+published: %s
+short: Short description of the post.
+tags:
+- untagged
+---
+
+Write your post here.
+`
 
-func loadTemplate(path string) (*text.Template, error) {
-	b, err := os.ReadFile(path)
+// CreatePost creates a new post, with a prefilled header, in a slugified sub dir of dir and returns it's path.
+// The dir is named using the same rules as the "slugify" template func.
+// It refuses to overwrite any existing post.
+func CreatePost(dir, title string, now time.Time) (string, error) {
+	title = strings.TrimSpace(title)
+	if len(title) < 1 {
+		return "", fmt.Errorf("missing title")
+	}
+	t, err := yaml.Marshal(title) // Makes sure the title is properly quoted, if needed
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	// Links made with slugify are unescaped by the web server, so they ends up at the same dir
+	name := slugName(title)
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("title %q can't be used as a dir name", title)
+	}
+	path := filepath.Join(dir, name, postOrig)
+	if err := createDir(path); err != nil {
+		return "", err
 	}
-	name := filepath.Base(path)
-	return text.New(name).Funcs(TemplateFuncs).Parse(string(b))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+	// Hopefully any errors will be already caught by Sync()
+	defer f.Close() // #nosec G307
+
+	header := fmt.Sprintf(newPostHeader, strings.TrimSpace(string(t)), now.Format(time.RFC3339))
+	if _, err := f.WriteString(header); err != nil {
+		return "", err
+	}
+	return path, f.Sync()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// layout is the base template, which all other templates are parsed together with.
+type layout struct {
+	name   string
+	src    string
+	escape bool         // false for the compatibility mode, when nothing is escaped
+	funcs  text.FuncMap // overrides TemplateFuncs, for funcs that depends on the generator
 }
 
-func cloneTemplate(base *text.Template, path string) (*text.Template, error) {
-	t, err := base.Clone()
+func loadTemplate(path string, escape bool, funcs text.FuncMap) (*layout, error) {
+	b, err := os.ReadFile(path) // #nosec G304
 	if err != nil {
 		return nil, err
 	}
-	b, err := os.ReadFile(path)
+	l := &layout{
+		name:   filepath.Base(path),
+		src:    string(b),
+		escape: escape,
+		funcs:  funcs,
+	}
+	// Parse it once for both template engines, to catch any errors early on
+	if _, err := l.parse(".html", "", ""); err != nil {
+		return nil, err
+	}
+	if _, err := l.parse(".txt", "", ""); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func cloneTemplate(base *layout, path string) (*pageTemplate, error) {
+	b, err := os.ReadFile(path) // #nosec G304
 	if err != nil {
 		return nil, err
 	}
-	name := filepath.Base(path)
-	return t.New(name).Parse(string(b))
+	return base.parse(filepath.Ext(path), filepath.Base(path), string(b))
+}
+
+// parse parses the layout together with the template src, using html/template for html pages and text/template
+// for everything else. Any output from xml templates are escaped too.
+func (l *layout) parse(ext, name, src string) (*pageTemplate, error) {
+	if l.escape && ext == ".html" {
+		t, err := html.New(l.name).Funcs(html.FuncMap(TemplateFuncs)).Funcs(html.FuncMap(l.funcs)).Parse(l.src)
+		if err == nil && name != "" {
+			t, err = t.New(name).Parse(src)
+		}
+		return &pageTemplate{html: t}, err
+	}
+
+	t, err := text.New(l.name).Funcs(TemplateFuncs).Funcs(l.funcs).Parse(l.src)
+	if err == nil && name != "" {
+		t, err = t.New(name).Parse(src)
+	}
+	if err == nil && l.escape && ext == ".xml" {
+		escapeXML(t)
+	}
+	return &pageTemplate{text: t}, err
+}
+
+// escapeXML adds the xmlescape func to the end of all actions that outputs something, in all the templates.
+// It's a dumb version of what html/template does.
+func escapeXML(t *text.Template) {
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			escapeNode(tmpl.Tree, tmpl.Tree.Root)
+		}
+	}
+}
+
+func escapeNode(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			escapeNode(tree, c)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return // Variable declarations doesn't output anything
+		}
+		ident := parse.NewIdentifier("xmlescape").SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{ident},
+		})
+	case *parse.IfNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.RangeNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	case *parse.WithNode:
+		escapeNode(tree, n.List)
+		escapeNode(tree, n.ElseList)
+	}
+}
+
+// Post methods that are derived from the post's body instead of it's header
+var bodyFields = map[string]bool{
+	"Body":                true,
+	"TableOfContents":     true,
+	"TableOfContentsHTML": true,
+	"WordCount":           true,
+	"ReadingTime":         true,
+	"Excerpt":             true,
+	"Summary":             true,
+}
+
+// usesBodies returns true if any of the templates refers to a field derived from the post bodies, like .Body or
+// .Summary. Other templates doesn't have to be regenerated when only the bodies has changed.
+func (t *pageTemplate) usesBodies() bool {
+	var trees []*parse.Tree
+	if t.html != nil {
+		for _, tmpl := range t.html.Templates() {
+			trees = append(trees, tmpl.Tree)
+		}
+	} else {
+		for _, tmpl := range t.text.Templates() {
+			trees = append(trees, tmpl.Tree)
+		}
+	}
+	for _, tree := range trees {
+		if tree != nil && nodeUsesBodies(tree.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeUsesBodies(node parse.Node) bool {
+	fields := func(idents []string) bool {
+		for _, i := range idents {
+			if bodyFields[i] {
+				return true
+			}
+		}
+		return false
+	}
+	branch := func(n *parse.BranchNode) bool {
+		return nodeUsesBodies(n.Pipe) || nodeUsesBodies(n.List) || nodeUsesBodies(n.ElseList)
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if nodeUsesBodies(c) {
+				return true
+			}
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if nodeUsesBodies(c) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if nodeUsesBodies(a) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesBodies(n.Pipe)
+	case *parse.TemplateNode:
+		return nodeUsesBodies(n.Pipe)
+	case *parse.IfNode:
+		return branch(&n.BranchNode)
+	case *parse.RangeNode:
+		return branch(&n.BranchNode)
+	case *parse.WithNode:
+		return branch(&n.BranchNode)
+	case *parse.FieldNode:
+		return fields(n.Ident)
+	case *parse.VariableNode:
+		return fields(n.Ident[1:])
+	case *parse.ChainNode:
+		return fields(n.Field) || nodeUsesBodies(n.Node)
+	}
+	return false
 }
 
-func executeTemplate(file string, tmpl *text.Template, data interface{}) error {
+// pageTemplate is a template that has been parsed with either html/template or text/template.
+type pageTemplate struct {
+	html *html.Template
+	text *text.Template
+}
+
+func (t *pageTemplate) funcs(m text.FuncMap) {
+	if t.html != nil {
+		t.html.Funcs(html.FuncMap(m))
+		return
+	}
+	t.text.Funcs(m)
+}
+
+func (t *pageTemplate) execute(w io.Writer, data interface{}) error {
+	if t.html != nil {
+		return t.html.Execute(w, data)
+	}
+	return t.text.Execute(w, data)
+}
+
+func renderTemplate(tmpl *pageTemplate, data interface{}) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := tmpl.ExecuteTemplate(&buf, tmpl.Name(), data); err != nil {
-		return err
+	if err := tmpl.execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// renderPages renders the template once for each page, if the template splits itself up into multiple pages
+// by calling "paginate".
+func renderPages(rel string, tmpl *pageTemplate, data func(*Paginator) interface{}) ([]output, error) {
+	var list []output
+	for page, total := 1, 1; page <= total; page++ {
+		pager := newPaginator(rel, page)
+		tmpl.funcs(text.FuncMap{"paginate": pager.paginate})
+		b, err := renderTemplate(tmpl, data(pager))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, output{rel: pager.pageRel(page), data: b})
+		total = pager.TotalPages
 	}
-	return writeFile(file, bytes.TrimSpace(buf.Bytes()))
+	return list, nil
 }
@@ -0,0 +1,83 @@
+// Copyright © 2021 Alex
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEscapeXML(t *testing.T) {
+	dir := t.TempDir()
+	layout := filepath.Join(dir, "layout.html")
+	if err := os.WriteFile(layout, []byte(`{{define "layout"}}{{.Value}}{{end}}`), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	feed := filepath.Join(dir, "feed.xml")
+	src := `<a>{{.Value}}</a>
+{{range .List}}<b>{{.}}</b>{{end}}
+{{if .Value}}<c>{{.Value}}</c>{{else}}<c></c>{{end}}
+{{with .Value}}<d>{{.}}</d>{{end}}
+{{$x := .Value}}<e>{{$x}}</e>
+<f>{{.Value | safehtml}}</f>
+<g>{{template "layout" .}}</g>`
+	if err := os.WriteFile(feed, []byte(src), filePerm); err != nil {
+		t.Fatal(err)
+	}
+	data := struct {
+		Value string
+		List  []string
+	}{`<&">`, []string{"1 < 2", "a & b"}}
+
+	tests := []struct {
+		escape bool
+		want   string
+	}{
+		{true, `<a>&lt;&amp;&#34;&gt;</a>
+<b>1 &lt; 2</b><b>a &amp; b</b>
+<c>&lt;&amp;&#34;&gt;</c>
+<d>&lt;&amp;&#34;&gt;</d>
+<e>&lt;&amp;&#34;&gt;</e>
+<f><&"></f>
+<g>&lt;&amp;&#34;&gt;</g>`},
+		// The compatibility mode doesn't escape anything
+		{false, `<a><&"></a>
+<b>1 < 2</b><b>a & b</b>
+<c><&"></c>
+<d><&"></d>
+<e><&"></e>
+<f><&"></f>
+<g><&"></g>`},
+	}
+	for _, tt := range tests {
+		l, err := loadTemplate(layout, tt.escape, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl, err := cloneTemplate(l, feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := renderTemplate(tmpl, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("escape %v: got:\n%s\nwant:\n%s", tt.escape, got, tt.want)
+		}
+	}
+}